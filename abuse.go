@@ -0,0 +1,170 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// announcesPerMinute is how many announce_peer queries a single IP may
+	// send before it counts as flooding.
+	announcesPerMinute = 30
+	// maxStrikes is the number of offences within strikeWindow after which a
+	// source is banned.
+	maxStrikes   = 10
+	strikeWindow = 10 * time.Minute
+	// banDuration is how long a banned source is ignored.
+	banDuration = time.Hour
+	// maxSources bounds the number of sources tracked at once.
+	maxSources = 100000
+	// sourceIdleAfter is how long a source is tracked after its last packet.
+	sourceIdleAfter = 5 * time.Minute
+)
+
+// source is what the guard tracks per IP or subnet.
+type source struct {
+	limiter     *rate.Limiter
+	announces   *rate.Limiter // nil for subnets
+	strikes     int
+	firstStrike time.Time
+	lastSeen    time.Time
+}
+
+// guard rate limits incoming packets per IP and per subnet, and bans the
+// sources which keep misbehaving for a while.
+type guard struct {
+	mu      sync.Mutex
+	ipRate  int // packets per second per IP, 0 for no limit
+	netRate int // packets per second per /24 or /48, 0 for no limit
+	ips     map[string]*source
+	subnets map[string]*source
+	banned  *blackList
+
+	limited atomic.Uint64 // packets dropped by a rate limit
+	dropped atomic.Uint64 // packets dropped from banned sources
+	strikes atomic.Uint64 // offences counted
+	bans    atomic.Uint64 // sources banned
+}
+
+func newGuard(ipRate, netRate int) *guard {
+	return &guard{
+		ipRate:  ipRate,
+		netRate: netRate,
+		ips:     make(map[string]*source),
+		subnets: make(map[string]*source),
+		banned:  newBlackList(banDuration, maxSources),
+	}
+}
+
+// subnet returns the /24 of an IPv4 or the /48 of an IPv6 address.
+func subnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// sourceLocked returns the source tracked under key, creating it unless too
+// many sources are tracked already.
+func (g *guard) sourceLocked(m map[string]*source, key string, perSec int) *source {
+	s, ok := m[key]
+	if !ok {
+		if len(m) >= maxSources {
+			return nil
+		}
+		s = &source{}
+		if perSec > 0 {
+			s.limiter = rate.NewLimiter(rate.Limit(perSec), perSec*2)
+		}
+		m[key] = s
+	}
+	s.lastSeen = time.Now()
+	return s
+}
+
+// allow reports whether a packet from ip should be processed.
+func (g *guard) allow(ip net.IP) bool {
+	if g.banned.has(ip.String()) {
+		g.dropped.Add(1)
+		return false
+	}
+
+	g.mu.Lock()
+	s := g.sourceLocked(g.ips, ip.String(), g.ipRate)
+	n := g.sourceLocked(g.subnets, subnet(ip), g.netRate)
+	flooding := s != nil && s.limiter != nil && !s.limiter.Allow()
+	limited := flooding || (n != nil && n.limiter != nil && !n.limiter.Allow())
+	g.mu.Unlock()
+
+	if limited {
+		g.limited.Add(1)
+	}
+	// a subnet may be busy through no fault of its own, a single IP not
+	if flooding {
+		g.strike(ip, "packet flood")
+	}
+	return !limited
+}
+
+// allowAnnounce reports whether ip may announce again, striking it if it
+// announces too often.
+func (g *guard) allowAnnounce(ip net.IP) bool {
+	g.mu.Lock()
+	s := g.sourceLocked(g.ips, ip.String(), g.ipRate)
+	if s != nil && s.announces == nil {
+		s.announces = rate.NewLimiter(per(announcesPerMinute, time.Minute), announcesPerMinute)
+	}
+	ok := s == nil || s.announces.Allow()
+	g.mu.Unlock()
+
+	if !ok {
+		g.strike(ip, "announce_peer flood")
+	}
+	return ok
+}
+
+// strike counts an offence of ip, banning it after too many of them.
+func (g *guard) strike(ip net.IP, reason string) {
+	g.strikes.Add(1)
+
+	g.mu.Lock()
+	s := g.sourceLocked(g.ips, ip.String(), g.ipRate)
+	ban := false
+	if s != nil {
+		if time.Since(s.firstStrike) > strikeWindow {
+			s.strikes = 0
+			s.firstStrike = time.Now()
+		}
+		s.strikes++
+		ban = s.strikes >= maxStrikes
+		if ban {
+			delete(g.ips, ip.String())
+		}
+	}
+	g.mu.Unlock()
+
+	if ban {
+		log.Printf("banning %s for %s: %s", ip, banDuration, reason)
+		g.bans.Add(1)
+		g.banned.add(ip.String())
+	}
+}
+
+// expire forgets the sources which have been idle for a while.
+func (g *guard) expire() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, m := range []map[string]*source{g.ips, g.subnets} {
+		for key, s := range m {
+			if time.Since(s.lastSeen) > sourceIdleAfter {
+				delete(m, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// dedupWindow is how long an infohash handed out for fetching is not
+	// queued again, whoever announces it.
+	dedupWindow = 10 * time.Minute
+	// seenHistory is how long an infohash handed out is remembered, so that
+	// never seen ones go first.
+	seenHistory = 24 * time.Hour
+	seenLimit   = 1000000
+	// maxCandidates bounds the peers collected for a queued infohash.
+	maxCandidates = 16
+)
+
+// announcements is the queue of infohashes to fetch the metadata of. An
+// infohash is queued once, collecting the peers of every announce of it, and
+// the infohashes never handed out before go ahead of the others.
+type announcements struct {
+	mu      sync.Mutex
+	fresh   *list.List // never handed out before
+	known   *list.List // handed out before, but not within dedupWindow
+	pending map[string]*list.Element
+	limit   int
+	input   chan struct{}
+	recent  *blackList // handed out within dedupWindow
+	seen    *blackList // handed out within seenHistory
+
+	// the peers announcing an infohash which is being fetched
+	followers map[string]chan []net.Addr
+
+	// optional, tells the infohashes not worth queuing, such as indexed ones
+	skip func(infohashHex string) bool
+
+	queued     atomic.Uint64 // infohashes queued
+	merged     atomic.Uint64 // announces merged into a queued or fetched infohash
+	duplicates atomic.Uint64 // announces of an infohash handed out within dedupWindow
+	skipped    atomic.Uint64 // announces refused by skip
+	dropped    atomic.Uint64 // announces dropped because the queue was full
+	evicted    atomic.Uint64 // known infohashes dropped for fresh ones
+}
+
+// queueStats is the snapshot of the announcement queue served over HTTP.
+type queueStats struct {
+	Fresh      int    `json:"fresh"`
+	Known      int    `json:"known"`
+	Limit      int    `json:"limit"`
+	Queued     uint64 `json:"queued"`
+	Merged     uint64 `json:"merged"`
+	Duplicates uint64 `json:"duplicates"`
+	Skipped    uint64 `json:"skipped"`
+	Dropped    uint64 `json:"dropped"`
+	Evicted    uint64 `json:"evicted"`
+}
+
+func newAnnouncements(limit int) *announcements {
+	return &announcements{
+		fresh:   list.New(),
+		known:   list.New(),
+		pending: make(map[string]*list.Element),
+		limit:   limit,
+		input:   make(chan struct{}, 1),
+		recent:  newBlackList(dedupWindow, seenLimit),
+		seen:    newBlackList(seenHistory, seenLimit),
+
+		followers: make(map[string]chan []net.Addr),
+	}
+}
+
+// get hands out the next infohash to fetch, a fresh one if any.
+func (a *announcements) get() *announcement {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, l := range []*list.List{a.fresh, a.known} {
+		if elem := l.Front(); elem != nil {
+			ac := elem.Value.(*announcement)
+			l.Remove(elem)
+			delete(a.pending, ac.infohashHex)
+
+			a.recent.add(ac.infohashHex)
+			a.seen.add(ac.infohashHex)
+			return ac
+		}
+	}
+
+	return nil
+}
+
+func (a *announcements) put(ac *announcement) {
+	if a.recent.has(ac.infohashHex) {
+		if a.pass(ac) {
+			a.merged.Add(1)
+		} else {
+			a.duplicates.Add(1)
+		}
+		return
+	}
+	if a.skip != nil && a.skip(ac.infohashHex) {
+		a.skipped.Add(1)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if elem, ok := a.pending[ac.infohashHex]; ok {
+		elem.Value.(*announcement).merge(ac.peers)
+		a.merged.Add(1)
+		return
+	}
+
+	fresh := !a.seen.has(ac.infohashHex)
+	if a.fresh.Len()+a.known.Len() >= a.limit {
+		oldest := a.known.Front()
+		if !fresh || oldest == nil {
+			a.dropped.Add(1)
+			log.Printf("announcements %d meet or exceed limit %d", a.fresh.Len()+a.known.Len(), a.limit)
+			return
+		}
+
+		a.known.Remove(oldest)
+		delete(a.pending, oldest.Value.(*announcement).infohashHex)
+		a.evicted.Add(1)
+	}
+
+	ac.merge(nil)
+	if fresh {
+		a.pending[ac.infohashHex] = a.fresh.PushBack(ac)
+	} else {
+		a.pending[ac.infohashHex] = a.known.PushBack(ac)
+	}
+	a.queued.Add(1)
+
+	select {
+	case a.input <- struct{}{}:
+	default:
+	}
+}
+
+// follow returns the peers announcing infohashHex from now on, until stop is
+// called, so that a fetch in progress can try them too.
+func (a *announcements) follow(infohashHex string) (peers <-chan []net.Addr, stop func()) {
+	ch := make(chan []net.Addr, maxCandidates)
+
+	a.mu.Lock()
+	a.followers[infohashHex] = ch
+	a.mu.Unlock()
+
+	return ch, func() {
+		a.mu.Lock()
+		if a.followers[infohashHex] == ch {
+			delete(a.followers, infohashHex)
+		}
+		a.mu.Unlock()
+	}
+}
+
+// pass hands the peers of ac to the fetch following its infohash, if any.
+func (a *announcements) pass(ac *announcement) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ch, ok := a.followers[ac.infohashHex]
+	if !ok {
+		return false
+	}
+
+	select {
+	case ch <- ac.peers:
+		return true
+	default:
+		// the fetch has enough candidates to go through already
+		return false
+	}
+}
+
+func (a *announcements) wait() <-chan struct{} {
+	return a.input
+}
+
+func (a *announcements) len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.fresh.Len() + a.known.Len()
+}
+
+// full reports whether even a fresh infohash would be dropped.
+func (a *announcements) full() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.fresh.Len() >= a.limit
+}
+
+func (a *announcements) stats() queueStats {
+	a.mu.Lock()
+	fresh, known := a.fresh.Len(), a.known.Len()
+	a.mu.Unlock()
+
+	return queueStats{
+		Fresh:      fresh,
+		Known:      known,
+		Limit:      a.limit,
+		Queued:     a.queued.Load(),
+		Merged:     a.merged.Load(),
+		Duplicates: a.duplicates.Load(),
+		Skipped:    a.skipped.Load(),
+		Dropped:    a.dropped.Load(),
+		Evicted:    a.evicted.Load(),
+	}
+}
+
+// merge adds the peers not yet among the candidates of ac, up to
+// maxCandidates.
+func (ac *announcement) merge(peers []net.Addr) {
+	have := make(map[string]bool)
+	candidates := ac.peers[:0]
+	for _, peer := range append(ac.peers, peers...) {
+		if len(candidates) >= maxCandidates {
+			break
+		}
+		if addr := peer.String(); !have[addr] {
+			have[addr] = true
+			candidates = append(candidates, peer)
+		}
+	}
+	ac.peers = candidates
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// maxBencodeDepth bounds the nesting of lists and dictionaries.
+const maxBencodeDepth = 64
+
+var errBencodeEnd = errors.New("bencode: unexpected end of data")
+
+// decodeBencode decodes the bencoded value at the start of data and returns
+// it with the number of bytes it takes, so that what follows it, like the
+// piece of a ut_metadata message, can be found. Values have the types
+// bencode.Decode gives them: map[string]interface{}, []interface{}, string
+// and int64.
+func decodeBencode(data []byte) (interface{}, int, error) {
+	d := &bdecoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, d.pos, err
+	}
+	return v, d.pos, nil
+}
+
+type bdecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *bdecoder) value(depth int) (interface{}, error) {
+	if depth > maxBencodeDepth {
+		return nil, errors.New("bencode: nested too deep")
+	}
+	if d.pos >= len(d.data) {
+		return nil, errBencodeEnd
+	}
+
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		d.pos++
+		return d.integer('e')
+	case c >= '0' && c <= '9':
+		return d.string()
+	case c == 'l':
+		d.pos++
+		list := []interface{}{}
+		for {
+			if d.pos >= len(d.data) {
+				return nil, errBencodeEnd
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return list, nil
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+	case c == 'd':
+		d.pos++
+		dict := make(map[string]interface{})
+		for {
+			if d.pos >= len(d.data) {
+				return nil, errBencodeEnd
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return dict, nil
+			}
+			key, err := d.string()
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = v
+		}
+	default:
+		return nil, fmt.Errorf("bencode: unexpected %q at %d", c, d.pos)
+	}
+}
+
+// integer reads the digits up to end.
+func (d *bdecoder) integer(end byte) (int64, error) {
+	i := bytes.IndexByte(d.data[d.pos:], end)
+	if i < 0 {
+		return 0, errBencodeEnd
+	}
+
+	n, err := strconv.ParseInt(string(d.data[d.pos:d.pos+i]), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bencode: bad integer at %d", d.pos)
+	}
+	d.pos += i + 1
+	return n, nil
+}
+
+func (d *bdecoder) string() (string, error) {
+	if d.pos >= len(d.data) || d.data[d.pos] < '0' || d.data[d.pos] > '9' {
+		return "", fmt.Errorf("bencode: expected a string at %d", d.pos)
+	}
+
+	start := d.pos
+	length, err := d.integer(':')
+	if err != nil {
+		return "", err
+	}
+	if length < 0 || length > int64(len(d.data)-d.pos) {
+		d.pos = start
+		return "", errBencodeEnd
+	}
+
+	s := string(d.data[d.pos : d.pos+int(length)])
+	d.pos += int(length)
+	return s, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"log"
+	"net"
+)
+
+// externalIPVotes is the number of nodes which must agree on our external IP
+// before we derive a new node ID from it.
+const externalIPVotes = 10
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// bep42Prefix returns the CRC32-C of ip masked and salted with r as described
+// in BEP 42, whose top 21 bits a compliant node ID starts with.
+func bep42Prefix(ip net.IP, r byte) uint32 {
+	var masked []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := []byte{0x03, 0x0f, 0x3f, 0xff}
+		masked = make([]byte, 4)
+		for i := range masked {
+			masked[i] = ip4[i] & mask[i]
+		}
+	} else {
+		mask := []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+		masked = make([]byte, 8)
+		for i := range masked {
+			masked[i] = ip[i] & mask[i]
+		}
+	}
+	masked[0] |= (r & 0x07) << 5
+
+	return crc32.Checksum(masked, castagnoli)
+}
+
+// maxBEP42Identities is the number of distinct prefixes BEP 42 leaves to one
+// IP, one for each value of the 3 bits of salt. More identities with --bep42
+// would share prefixes and crawl the same slice of the keyspace.
+const maxBEP42Identities = 8
+
+// bep42ID derives a node ID which is valid for ip, using r as the random
+// salt so that several IDs can be derived for the same IP.
+func bep42ID(ip net.IP, r byte) nodeID {
+	crc := bep42Prefix(ip, r)
+
+	id := randBytes(20)
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x07
+	id[19] = r & 0x07
+	return id
+}
+
+// bep42Exempt reports whether nodes at ip are exempt from the BEP 42 check,
+// as local addresses are.
+func bep42Exempt(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// bep42Valid reports whether id is a valid node ID for a node at ip.
+func bep42Valid(id string, ip net.IP) bool {
+	if len(id) != 20 {
+		return false
+	}
+
+	crc := bep42Prefix(ip, id[19])
+	return id[0] == byte(crc>>24) &&
+		id[1] == byte(crc>>16) &&
+		id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+// encodeAddr encodes addr as compact IP and port, as in the "ip" field of
+// BEP 42.
+func encodeAddr(addr net.UDPAddr) string {
+	ip := addr.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	b := make([]byte, len(ip)+2)
+	copy(b, ip)
+	binary.BigEndian.PutUint16(b[len(ip):], uint16(addr.Port))
+	return string(b)
+}
+
+func decodeAddr(s string) (net.IP, int, bool) {
+	if len(s) != 6 && len(s) != 18 {
+		return nil, 0, false
+	}
+
+	ipLen := len(s) - 2
+	return net.IP([]byte(s[:ipLen])), int(binary.BigEndian.Uint16([]byte(s[ipLen:]))), true
+}
+
+// checkID counts whether a node we have not checked recently has a BEP 42
+// compliant ID, and reports whether it may enter our routing table.
+func (d *dht) checkID(id string, from net.UDPAddr) bool {
+	if bep42Exempt(from.IP) {
+		return true
+	}
+
+	valid := bep42Valid(id, from.IP)
+
+	key := from.String()
+	if !d.checkedIDs.has(key) {
+		d.checkedIDs.add(key)
+		if valid {
+			d.counters.compliant.Add(1)
+		} else {
+			d.counters.nonCompliant.Add(1)
+		}
+	}
+
+	return valid || !d.bep42
+}
+
+// voteExternalIP records the external IP a node told us it sees us at. Once
+// enough nodes agree, our node ID is derived from it if it is not compliant
+// yet.
+func (d *dht) voteExternalIP(s string, from net.UDPAddr) {
+	if !d.bep42 {
+		return
+	}
+
+	ip, _, ok := decodeAddr(s)
+	if !ok || bep42Exempt(ip) {
+		return
+	}
+
+	// the ID can only be compliant with one family, prefer IPv4
+	if !isIPv4(ip) && d.conn != nil {
+		return
+	}
+
+	d.votesMu.Lock()
+	if len(d.votes) >= 1000 {
+		d.votes = make(map[string]string)
+	}
+	d.votes[from.IP.String()] = ip.String()
+
+	count := 0
+	for _, v := range d.votes {
+		if v == ip.String() {
+			count++
+		}
+	}
+	d.votesMu.Unlock()
+
+	if count >= externalIPVotes {
+		d.setExternalIP(ip)
+	}
+}
+
+// setExternalIP derives a new node ID from ip if ours is not compliant with
+// it and BEP 42 is enabled.
+func (d *dht) setExternalIP(ip net.IP) {
+	if !d.bep42 || bep42Valid(string(d.id()), ip) {
+		return
+	}
+
+	id := bep42ID(ip, d.bep42Salt)
+	log.Printf("external IP is %s, deriving node ID from it: %x", ip, id)
+	d.setID(id)
+}
+
+func (d *dht) id() nodeID {
+	d.idMu.RLock()
+	defer d.idMu.RUnlock()
+
+	return d.localID
+}
+
+func (d *dht) setID(id nodeID) {
+	d.idMu.Lock()
+	d.localID = id
+	d.idMu.Unlock()
+
+	for _, table := range d.tables() {
+		table.setLocalID(id)
+	}
+}
+
+// idFor returns the ID we present to a node whose ID is target: one close to
+// it so that the node keeps us in its routing table, unless BEP 42 compliance
+// forbids forging IDs.
+func (d *dht) idFor(target nodeID) string {
+	if d.bep42 {
+		return string(d.id())
+	}
+	return string(neighborID(target, d.id()))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// truncateInfohash returns the 20 bytes of an infohash used in the DHT and in
+// the peer handshake: v1 infohashes as they are, v2 ones truncated.
+func truncateInfohash(infohash string) (string, bool) {
+	switch len(infohash) {
+	case sha1.Size:
+		return infohash, true
+	case sha256.Size:
+		return infohash[:sha1.Size], true
+	}
+	return "", false
+}
+
+// verifyMetadata reports whether meta is the info dictionary of infohash,
+// either as the SHA-1 of a v1 or hybrid torrent or as the truncated SHA-256 of
+// a v2 or hybrid torrent.
+func verifyMetadata(meta []byte, infohash string) bool {
+	v1 := sha1.Sum(meta)
+	if bytes.Equal(v1[:], []byte(infohash)) {
+		return true
+	}
+
+	v2 := sha256.Sum256(meta)
+	return bytes.Equal(v2[:sha1.Size], []byte(infohash))
+}
+
+// infohashes sets the v1 and v2 infohashes of t from its info dictionary
+// meta, depending on the meta version and the v1 fields it has.
+func (t *torrent) infohashes(meta []byte, dict map[string]interface{}) {
+	if _, ok := dict["pieces"].(string); ok {
+		v1 := sha1.Sum(meta)
+		t.InfohashV1 = hex.EncodeToString(v1[:])
+	}
+
+	if version, ok := dict["meta version"].(int64); ok && version == 2 {
+		v2 := sha256.Sum256(meta)
+		t.InfohashV2 = hex.EncodeToString(v2[:])
+	}
+}
+
+// aliasHex returns the DHT infohash of t other than the one it is indexed
+// under, if it is a hybrid torrent.
+func (t *torrent) aliasHex() string {
+	if t.InfohashV1 == "" || t.InfohashV2 == "" {
+		return ""
+	}
+
+	if t.InfohashHex == t.InfohashV1 {
+		return t.InfohashV2[:2*sha1.Size]
+	}
+	return t.InfohashV1
+}
+
+func aliasKey(infohashHex string) []byte {
+	return []byte("alias:" + infohashHex)
+}
+
+// magnet returns the magnet link of t, with a btih for v1 and a btmh for v2.
+func (t *torrent) magnet() string {
+	var xt []string
+	switch {
+	case t.InfohashV1 != "":
+		xt = append(xt, "xt=urn:btih:"+t.InfohashV1)
+	case t.InfohashV2 == "":
+		// not parsed from metadata, all we know is the indexed infohash
+		xt = append(xt, "xt=urn:btih:"+t.InfohashHex)
+	}
+	if t.InfohashV2 != "" {
+		// multihash of a SHA-256: function 0x12, length 0x20
+		xt = append(xt, "xt=urn:btmh:1220"+t.InfohashV2)
+	}
+
+	link := "magnet:?" + strings.Join(xt, "&")
+	if t.Name != "" {
+		link += "&dn=" + url.QueryEscape(t.Name)
+	}
+	return link
+}
+
+// fileTree returns the files of a BEP 52 file tree, where each directory is a
+// dictionary of its entries and each file a dictionary holding its length
+// under the empty key.
+func fileTree(tree map[string]interface{}, path []string) (files []*tfile) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		entry, ok := tree[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if name == "" {
+			length, _ := entry["length"].(int64)
+			files = append(files, &tfile{Name: strings.Join(path, "/"), Length: length})
+			continue
+		}
+
+		files = append(files, fileTree(entry, append(path[:len(path):len(path)], name))...)
+	}
+
+	return
+}
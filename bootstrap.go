@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+var bootstrapSeeds = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+	"router.bitcomet.com:6881",
+	"dht.aelitis.com:6881",
+}
+
+// parseBootstrapNode parses a seed given either as host:port or as the hex
+// encoded compact node info of a single IPv4 or IPv6 node. The ID of a
+// host:port seed is left empty.
+func parseBootstrapNode(s string) (*node, error) {
+	if _, _, err := net.SplitHostPort(s); err == nil {
+		return &node{addr: s}, nil
+	}
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bootstrap node %q: neither host:port nor hex compact node info", s)
+	}
+
+	var nodes []*node
+	switch len(b) {
+	case 20 + net.IPv4len + 2:
+		nodes = decodeNodes(string(b))
+	case 20 + net.IPv6len + 2:
+		nodes = decodeNodes6(string(b))
+	}
+	if len(nodes) != 1 {
+		return nil, fmt.Errorf("invalid bootstrap node %q: compact node info of %d bytes", s, len(b))
+	}
+
+	return nodes[0], nil
+}
+
+// loadBootstrapFile reads seeds from a file holding one seed per line, in any
+// format accepted by parseBootstrapNode. Blank lines and lines starting with
+// # are ignored.
+func loadBootstrapFile(path string) ([]*node, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var nodes []*node
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		n, err := parseBootstrapNode(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		nodes = append(nodes, n)
+	}
+
+	return nodes, scanner.Err()
+}
+
+// bootstrapNodes returns the seeds given on the command line and in the seed
+// file, or the public routers if there are none.
+func bootstrapNodes(seeds []string, file string) ([]*node, error) {
+	var nodes []*node
+	for _, s := range seeds {
+		n, err := parseBootstrapNode(s)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+
+	if file != "" {
+		fileNodes, err := loadBootstrapFile(file)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, fileNodes...)
+	}
+
+	if len(nodes) == 0 {
+		for _, addr := range bootstrapSeeds {
+			nodes = append(nodes, &node{addr: addr})
+		}
+	}
+
+	return nodes, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxClients bounds the distinct clients counted, the rest are "other".
+	maxClients = 1024
+	// maxYourIPs bounds the distinct addresses peers told us we have.
+	maxYourIPs = 64
+)
+
+// azureusClients names the clients by the two letters of their
+// Azureus-style peer IDs, "-qB4250-".
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"KT": "KTorrent",
+	"LT": "libtorrent (rakshasa)",
+	"lt": "libtorrent (rasterbar)",
+	"PI": "PicoTorrent",
+	"qB": "qBittorrent",
+	"TL": "Tribler",
+	"TR": "Transmission",
+	"UT": "µTorrent",
+	"UM": "µTorrent for Mac",
+	"WD": "WebTorrent Desktop",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+	"SD": "Xunlei",
+}
+
+// peerClient names the client of a peer ID and its version, if the ID
+// follows the Azureus or the Mainline convention.
+func peerClient(peerID string) string {
+	if len(peerID) < 8 {
+		return "unknown"
+	}
+
+	switch {
+	case peerID[0] == '-' && peerID[7] == '-':
+		name, ok := azureusClients[peerID[1:3]]
+		if !ok {
+			name = fmt.Sprintf("unknown %q", peerID[1:3])
+		}
+
+		var version []string
+		for _, c := range peerID[3:7] {
+			switch {
+			case c >= '0' && c <= '9':
+				version = append(version, string(c))
+			case c >= 'A' && c <= 'Z':
+				version = append(version, fmt.Sprint(c-'A'+10))
+			default:
+				return name
+			}
+		}
+		// "4250" is 4.2.5
+		for len(version) > 2 && version[len(version)-1] == "0" {
+			version = version[:len(version)-1]
+		}
+		return name + " " + strings.Join(version, ".")
+	case peerID[0] == 'M' && peerID[2] == '-':
+		// "M7-10-1-" or "M4-3-6--", then random bytes
+		version := peerID[1:8]
+		if i := strings.IndexFunc(version, func(c rune) bool {
+			return c != '-' && (c < '0' || c > '9')
+		}); i >= 0 {
+			version = version[:i]
+		}
+		return "Mainline " + strings.ReplaceAll(strings.TrimRight(version, "-"), "-", ".")
+	}
+	return "unknown"
+}
+
+// clientCount is how many peers a client was seen as.
+type clientCount struct {
+	Client  string `json:"client"`  // "v" of the extension handshake
+	PeerID  string `json:"peerId"`  // the client as its peer ID tells
+	Peers   uint64 `json:"peers"`   // peers handshaken with
+	Fetched uint64 `json:"fetched"` // peers which gave us the metadata
+	Reqq    int    `json:"reqq"`    // the most outstanding requests one took
+}
+
+// ipCount is how many peers told us our address is IP.
+type ipCount struct {
+	IP    string `json:"ip"`
+	Peers uint64 `json:"peers"`
+}
+
+// clientsResponse is the client distribution served over HTTP.
+type clientsResponse struct {
+	Peers   uint64        `json:"peers"`
+	Clients []clientCount `json:"clients"`
+	YourIPs []ipCount     `json:"yourIPs"`
+}
+
+// clientStats aggregates the clients of the peers we fetched from.
+type clientStats struct {
+	mu      sync.Mutex
+	peers   uint64
+	clients map[string]*clientCount
+	yourIPs map[string]uint64
+}
+
+func newClientStats() *clientStats {
+	return &clientStats{
+		clients: make(map[string]*clientCount),
+		yourIPs: make(map[string]uint64),
+	}
+}
+
+// count records the peer of r, if it got as far as the handshake.
+func (s *clientStats) count(r fetchResult) {
+	if r.peerID == "" {
+		return
+	}
+
+	byID := peerClient(r.peerID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.peers++
+
+	key := r.client + "\x00" + byID
+	c, ok := s.clients[key]
+	if !ok {
+		c = &clientCount{Client: r.client, PeerID: byID}
+		if len(s.clients) >= maxClients {
+			key = "\x00other"
+			if c, ok = s.clients[key]; !ok {
+				c = &clientCount{Client: "other", PeerID: "other"}
+			}
+		}
+		s.clients[key] = c
+	}
+	c.Peers++
+	if r.err == nil {
+		c.Fetched++
+	}
+	if r.reqq > c.Reqq {
+		c.Reqq = r.reqq
+	}
+
+	if r.yourIP != nil {
+		ip := r.yourIP.String()
+		if _, ok := s.yourIPs[ip]; ok || len(s.yourIPs) < maxYourIPs {
+			s.yourIPs[ip]++
+		}
+	}
+}
+
+// snapshot returns the clients and addresses, the most seen first.
+func (s *clientStats) snapshot() clientsResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	response := clientsResponse{
+		Peers:   s.peers,
+		Clients: make([]clientCount, 0, len(s.clients)),
+		YourIPs: make([]ipCount, 0, len(s.yourIPs)),
+	}
+	for _, c := range s.clients {
+		response.Clients = append(response.Clients, *c)
+	}
+	for ip, n := range s.yourIPs {
+		response.YourIPs = append(response.YourIPs, ipCount{IP: ip, Peers: n})
+	}
+
+	sort.Slice(response.Clients, func(i, j int) bool {
+		a, b := response.Clients[i], response.Clients[j]
+		if a.Peers != b.Peers {
+			return a.Peers > b.Peers
+		}
+		return a.Client+a.PeerID < b.Client+b.PeerID
+	})
+	sort.Slice(response.YourIPs, func(i, j int) bool {
+		a, b := response.YourIPs[i], response.YourIPs[j]
+		if a.Peers != b.Peers {
+			return a.Peers > b.Peers
+		}
+		return a.IP < b.IP
+	})
+
+	return response
+}
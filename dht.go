@@ -2,13 +2,13 @@ package main
 
 import (
 	"bytes"
-	"container/list"
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
 	"log"
 	"net"
+	"os"
 	"strconv"
 	"sync"
 	"time"
@@ -17,77 +17,25 @@ import (
 	"golang.org/x/time/rate"
 )
 
-var bootstrapSeeds = []string{
-	"router.bittorrent.com:6881",
-	"dht.transmissionbt.com:6881",
-	"router.utorrent.com:6881",
-	"router.bitcomet.com:6881",
-	"dht.aelitis.com:6881",
-}
-
 type nodeID []byte
 
 type node struct {
-	addr string
-	id   string
-}
-
-type announcements struct {
-	mu    sync.RWMutex
-	ll    *list.List
-	limit int
-	input chan struct{}
-}
-
-func (a *announcements) get() *announcement {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-
-	if elem := a.ll.Front(); elem != nil {
-		ac := elem.Value.(*announcement)
-		a.ll.Remove(elem)
-		return ac
-	}
-
-	return nil
-}
-
-func (a *announcements) put(ac *announcement) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-
-	if a.ll.Len() >= a.limit {
-		log.Printf("accouncements %d meet or exceed limit %d", a.ll.Len(), a.limit)
-		return
-	}
-
-	a.ll.PushBack(ac)
-
-	select {
-	case a.input <- struct{}{}:
-	default:
-	}
+	addr     string
+	id       string
+	lastSeen time.Time
+	failures int
+	rtt      time.Duration // of the last answered query, zero if unknown
 }
 
-func (a *announcements) wait() <-chan struct{} {
-	return a.input
-}
-
-func (a *announcements) len() int {
-	a.mu.RLock()
-	defer a.mu.RUnlock()
-
-	return a.ll.Len()
-}
-
-func (a *announcements) full() bool {
-	return a.len() >= a.limit
+func (n *node) copy() *node {
+	c := *n
+	return &c
 }
 
 type announcement struct {
 	raw         map[string]interface{}
 	from        net.UDPAddr
-	peer        net.Addr
+	peers       []net.Addr // candidates to fetch the metadata from
 	infohash    []byte
 	infohashHex string
 }
@@ -123,24 +71,69 @@ func makeReply(tid string, r map[string]interface{}) map[string]interface{} {
 	}
 }
 
-func decodeNodes(s string) (nodes []*node) {
+// decodeNodes decodes the compact IPv4 node info of a "nodes" value.
+func decodeNodes(s string) []*node {
+	return decodeCompactNodes(s, net.IPv4len)
+}
+
+// decodeNodes6 decodes the compact IPv6 node info of a "nodes6" value (BEP 32).
+func decodeNodes6(s string) []*node {
+	return decodeCompactNodes(s, net.IPv6len)
+}
+
+func decodeCompactNodes(s string, ipLen int) (nodes []*node) {
+	size := 20 + ipLen + 2
 	length := len(s)
-	if length%26 != 0 {
-		log.Printf("length %d not multiple of 26", length)
+	if length%size != 0 {
+		log.Printf("length %d not multiple of %d", length, size)
 		return
 	}
 
-	for i := 0; i < length; i += 26 {
+	for i := 0; i < length; i += size {
 		id := s[i : i+20]
-		ip := net.IP([]byte(s[i+20 : i+24])).String()
-		port := binary.BigEndian.Uint16([]byte(s[i+24 : i+26]))
-		addr := ip + ":" + strconv.Itoa(int(port))
+		ip := net.IP([]byte(s[i+20 : i+20+ipLen])).String()
+		port := binary.BigEndian.Uint16([]byte(s[i+20+ipLen : i+size]))
+		addr := net.JoinHostPort(ip, strconv.Itoa(int(port)))
 		nodes = append(nodes, &node{id: id, addr: addr})
 	}
 
 	return
 }
 
+// encodeNodes encodes nodes as compact node info, skipping those not of the
+// family given by ipLen.
+func encodeNodes(nodes []*node, ipLen int) string {
+	buf := bytes.NewBuffer(nil)
+	for _, n := range nodes {
+		host, port, err := net.SplitHostPort(n.addr)
+		if err != nil {
+			continue
+		}
+
+		ip := net.ParseIP(host)
+		if ipLen == net.IPv4len {
+			ip = ip.To4()
+		}
+		if ip == nil || len(ip) != ipLen || (ipLen == net.IPv6len && isIPv4(ip)) {
+			continue
+		}
+
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			continue
+		}
+
+		buf.WriteString(n.id)
+		buf.Write(ip)
+		binary.Write(buf, binary.BigEndian, uint16(p))
+	}
+	return buf.String()
+}
+
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
 func per(events int, duration time.Duration) rate.Limit {
 	return rate.Every(duration / time.Duration(events))
 }
@@ -150,37 +143,183 @@ type dht struct {
 	announcements  *announcements
 	chNode         chan *node
 	die            chan struct{}
+	dieOnce        sync.Once
 	errDie         error
-	localID        nodeID
-	conn           *net.UDPConn
+	idMu           sync.RWMutex
+	localID        nodeID    // use id() and setID()
+	conn           transport // IPv4, nil if not listening
+	conn6          transport // IPv6, nil if not listening
 	queryTypes     map[string]func(map[string]interface{}, net.UDPAddr)
 	friendsLimiter *rate.Limiter
 	secret         []byte
-	seeds          map[string]struct{}
+	table          *routingTable // IPv4 nodes
+	table6         *routingTable // IPv6 nodes
+	transactions   *transactions
+	lookupSlots    chan struct{}
+	harvested      *blackList // sampled or wanted infohashes recently resolved with a lookup
+	sample         bool
+	sampleMu       sync.Mutex
+	nextSample     map[string]time.Time // by node address
+	statePath      string
+	restored       []*node // nodes loaded from the saved state
+	bootstrap      []*node
+	counters       dhtStats
+	bep42          bool
+	bep42Salt      byte
+	checkedIDs     *blackList // nodes whose ID compliance was counted recently
+	votesMu        sync.Mutex
+	votes          map[string]string // external IP by the IP of the node which told us
+	guard          *guard
+	replay         bool
+}
+
+type dhtConfig struct {
+	laddr            string
+	maxFriendsPerSec int
+	sample           bool    // actively crawl with BEP 51 sample_infohashes
+	statePath        string  // where to persist the node ID and nodes, empty to disable
+	bootstrap        []*node // seeds to join the DHT through, by address and optional ID
+	localID          nodeID  // optional, random if nil; a saved state takes precedence
+	bep42            bool    // derive our node ID from our external IP, refuse non-compliant nodes
+	bep42Salt        byte    // the r of BEP 42 to derive the node ID with
+	externalIP       net.IP  // optional, learnt from replies otherwise
+	maxPacketsPerIP  int     // inbound packets per second per IP, 0 for no limit
+	maxPacketsPerNet int     // inbound packets per second per /24 or /48, 0 for no limit
+	replay           bool    // replaying recorded traffic: any token, no announce limit, no lookups
+
+	// optional, transports to use instead of listening on laddr
+	conn  transport
+	conn6 transport
+
+	// optional, shared by the identities of a process
+	announcements *announcements
+	harvested     *blackList
+}
+
+// listenUDP opens an IPv4 and an IPv6 socket when laddr has no host, or a
+// single socket of the family of the given host otherwise. BEP 32 requires
+// separate sockets and routing tables for each family.
+func listenUDP(laddr string) (conn, conn6 transport, err error) {
+	host, port, err := net.SplitHostPort(laddr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if host != "" {
+		c, err := net.ListenPacket("udp", laddr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isIPv4(c.LocalAddr().(*net.UDPAddr).IP) {
+			return c, nil, nil
+		}
+		return nil, c, nil
+	}
+
+	c4, err4 := net.ListenPacket("udp4", ":"+port)
+	if err4 == nil {
+		conn = c4
+	} else {
+		log.Printf("IPv4 DHT disabled: %v", err4)
+	}
+
+	c6, err6 := net.ListenPacket("udp6", ":"+port)
+	if err6 == nil {
+		conn6 = c6
+	} else {
+		log.Printf("IPv6 DHT disabled: %v", err6)
+	}
+
+	if conn == nil && conn6 == nil {
+		return nil, nil, err4
+	}
+	return conn, conn6, nil
 }
 
-func newDHT(laddr string, maxFriendsPerSec int) (*dht, error) {
-	log.Printf("Initializing DHT with local address: %s", laddr)
-	conn, err := net.ListenPacket("udp", laddr)
-	if err != nil {
-		return nil, err
+func newDHT(cfg dhtConfig) (*dht, error) {
+	conn, conn6 := cfg.conn, cfg.conn6
+	if conn == nil && conn6 == nil {
+		log.Printf("Initializing DHT with local address: %s", cfg.laddr)
+
+		var err error
+		conn, conn6, err = listenUDP(cfg.laddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	localID := cfg.localID
+	if localID == nil {
+		localID = randBytes(20)
+	}
+
+	var restored []*node
+	if cfg.statePath != "" {
+		if state, err := loadState(cfg.statePath); err == nil {
+			var id nodeID
+			if id, restored = state.restore(); id != nil {
+				localID = id
+			}
+			log.Printf("loaded DHT state with %d nodes from %s", len(restored), cfg.statePath)
+		} else if !os.IsNotExist(err) {
+			log.Printf("error loading DHT state from %s: %v", cfg.statePath, err)
+		}
+	}
+
+	if cfg.bep42 && cfg.externalIP != nil && !bep42Exempt(cfg.externalIP) && !bep42Valid(string(localID), cfg.externalIP) {
+		localID = bep42ID(cfg.externalIP, cfg.bep42Salt)
+		log.Printf("external IP is %s, deriving node ID from it: %x", cfg.externalIP, localID)
+	}
+
+	if cfg.announcements == nil {
+		cfg.announcements = newAnnouncements(cfg.maxFriendsPerSec * 10)
+	}
+	if cfg.harvested == nil {
+		cfg.harvested = newBlackList(time.Hour, 100000)
 	}
 
 	d := &dht{
-		announcements: &announcements{
-			ll:    list.New(),
-			limit: maxFriendsPerSec * 10,
-			input: make(chan struct{}, 1),
-		},
-		localID: randBytes(20),
-		conn:    conn.(*net.UDPConn),
-		chNode:  make(chan *node),
-		die:     make(chan struct{}),
-		secret:  randBytes(20),
-		seeds:   make(map[string]struct{}),
-	}
-	d.friendsLimiter = rate.NewLimiter(per(maxFriendsPerSec, time.Second), maxFriendsPerSec)
+		announcements: cfg.announcements,
+		localID:       localID,
+		conn:          conn,
+		conn6:         conn6,
+		chNode:        make(chan *node),
+		die:           make(chan struct{}),
+		secret:        randBytes(20),
+		transactions:  newTransactions(),
+		lookupSlots:   make(chan struct{}, maxConcurrentLookups),
+		harvested:     cfg.harvested,
+		sample:        cfg.sample,
+		nextSample:    make(map[string]time.Time),
+		statePath:     cfg.statePath,
+		bootstrap:     cfg.bootstrap,
+		bep42:         cfg.bep42,
+		bep42Salt:     cfg.bep42Salt,
+		checkedIDs:    newBlackList(time.Hour, 100000),
+		votes:         make(map[string]string),
+		guard:         newGuard(cfg.maxPacketsPerIP, cfg.maxPacketsPerNet),
+		replay:        cfg.replay,
+	}
+	if conn != nil {
+		d.table = newRoutingTable(localID)
+	}
+	if conn6 != nil {
+		d.table6 = newRoutingTable(localID)
+	}
+	for _, n := range restored {
+		addr, err := net.ResolveUDPAddr("udp", n.addr)
+		if err != nil {
+			continue
+		}
+		if table := d.tableFor(addr.IP); table != nil {
+			table.insert(n)
+			d.restored = append(d.restored, n.copy())
+		}
+	}
+	d.friendsLimiter = rate.NewLimiter(per(cfg.maxFriendsPerSec, time.Second), cfg.maxFriendsPerSec)
 	d.queryTypes = map[string]func(map[string]interface{}, net.UDPAddr){
+		"ping":          d.onPingQuery,
+		"find_node":     d.onFindNodeQuery,
 		"get_peers":     d.onGetPeersQuery,
 		"announce_peer": d.onAnnouncePeerQuery,
 	}
@@ -189,50 +328,111 @@ func newDHT(laddr string, maxFriendsPerSec int) (*dht, error) {
 
 func (d *dht) run() {
 	log.Println("Starting DHT listener...")
-	go d.listen()
+	for _, conn := range []transport{d.conn, d.conn6} {
+		if conn != nil {
+			go d.listen(conn)
+		}
+	}
 	go d.join()
 	go d.makeFriends()
 
-	// Periodically refresh the seeds
-	ticker := time.NewTicker(10 * time.Minute)
+	// Periodically refresh the routing table, expire unanswered queries and
+	// save the state
+	ticker := time.NewTicker(time.Minute)
+	expireTicker := time.NewTicker(time.Second)
+	saveTicker := time.NewTicker(5 * time.Minute)
 	go func() {
 		for {
 			select {
 			case <-ticker.C:
 				d.refresh()
+				d.guard.expire()
+			case <-expireTicker.C:
+				d.expireTransactions()
+			case <-saveTicker.C:
+				d.save()
 			case <-d.die:
 				ticker.Stop()
+				expireTicker.Stop()
+				saveTicker.Stop()
 				return
 			}
 		}
 	}()
 }
 
-func (d *dht) listen() {
+func (d *dht) listen(conn transport) {
 	buf := make([]byte, 2048)
 	for {
 		// log.Println("Listening for incoming messages...")
-		n, addr, err := d.conn.ReadFromUDP(buf)
-		// log.Printf("Received message from %s with size %d bytes", addr.String(), n)
+		n, from, err := conn.ReadFrom(buf)
+		// log.Printf("Received message from %s with size %d bytes", from.String(), n)
 		if err == nil {
-			d.onMessage(buf[:n], *addr)
+			addr, ok := from.(*net.UDPAddr)
+			if ok && d.guard.allow(addr.IP) {
+				d.onMessage(buf[:n], *addr)
+			}
 		} else {
-			d.errDie = err
-			close(d.die)
+			d.dieOnce.Do(func() {
+				d.errDie = err
+				close(d.die)
+			})
 			break
 		}
 	}
 }
 
+// save persists the DHT state if a state path is configured.
+func (d *dht) save() {
+	if d.statePath == "" {
+		return
+	}
+
+	if err := d.saveState(d.statePath); err != nil {
+		log.Printf("error saving DHT state to %s: %v", d.statePath, err)
+	}
+}
+
 func (d *dht) join() {
 	const timesForSure = 3
+
+	// the nodes we knew before the restart are most likely still alive
+	for _, n := range d.restored {
+		select {
+		case d.chNode <- n:
+		case <-d.die:
+			return
+		}
+	}
+
+	// resolve the seeds once for every family we listen on, so that both
+	// routing tables get bootstrapped
+	var seeds []*node
+	for _, seed := range d.bootstrap {
+		var resolved bool
+		for _, network := range d.networks() {
+			addr, err := net.ResolveUDPAddr(network, seed.addr)
+			if err != nil {
+				continue
+			}
+			resolved = true
+
+			id := seed.id
+			if id == "" {
+				id = string(randBytes(20))
+			}
+			seeds = append(seeds, &node{addr: addr.String(), id: id})
+		}
+
+		if !resolved {
+			log.Printf("error resolving bootstrap seed %s", seed.addr)
+		}
+	}
+
 	for i := 0; i < timesForSure; i++ {
-		for _, addr := range bootstrapSeeds {
+		for _, seed := range seeds {
 			select {
-			case d.chNode <- &node{
-				addr: addr,
-				id:   string(randBytes(20)),
-			}:
+			case d.chNode <- seed:
 			case <-d.die:
 				return
 			}
@@ -240,55 +440,156 @@ func (d *dht) join() {
 	}
 }
 
+func (d *dht) networks() []string {
+	var networks []string
+	if d.conn != nil {
+		networks = append(networks, "udp4")
+	}
+	if d.conn6 != nil {
+		networks = append(networks, "udp6")
+	}
+	return networks
+}
+
+func (d *dht) tables() []*routingTable {
+	var tables []*routingTable
+	if d.table != nil {
+		tables = append(tables, d.table)
+	}
+	if d.table6 != nil {
+		tables = append(tables, d.table6)
+	}
+	return tables
+}
+
+// tableFor returns the routing table for the family of ip, or nil if we are
+// not listening on that family.
+func (d *dht) tableFor(ip net.IP) *routingTable {
+	if isIPv4(ip) {
+		return d.table
+	}
+	return d.table6
+}
+
+// want returns the "want" argument of BEP 32 asking for nodes of every family
+// we listen on.
+func (d *dht) want() []interface{} {
+	var want []interface{}
+	if d.conn != nil {
+		want = append(want, "n4")
+	}
+	if d.conn6 != nil {
+		want = append(want, "n6")
+	}
+	return want
+}
+
+// wants reports which node families a query asks for, defaulting to the
+// family it was sent over.
+func wants(a map[string]interface{}, from net.UDPAddr) (n4, n6 bool) {
+	want, ok := a["want"].([]interface{})
+	if !ok || len(want) == 0 {
+		return isIPv4(from.IP), !isIPv4(from.IP)
+	}
+
+	for _, w := range want {
+		switch w {
+		case "n4":
+			n4 = true
+		case "n6":
+			n6 = true
+		}
+	}
+	return
+}
+
+// refresh pings the nodes we have not heard from for a while, looks up a
+// random target in every bucket that has gone stale and asks every good node
+// for more friends so the crawl keeps going.
 func (d *dht) refresh() int {
+	var nodes []*node
+	for _, table := range d.tables() {
+		for _, n := range table.questionable() {
+			d.ping(n)
+		}
 
-	d.mu.Lock()
-	count := len(d.seeds)
-	seeds := make(map[string]struct{}, count)
-	for k, v := range d.seeds {
-		seeds[k] = v
+		for _, target := range table.staleTargets() {
+			for _, n := range table.closest(target, bucketSize) {
+				d.findNodeTarget(n.addr, target)
+			}
+		}
+
+		nodes = append(nodes, table.nodes()...)
+	}
+
+	d.pruneSamples()
+
+	if len(nodes) == 0 {
+		go d.join()
+		return 0
 	}
-	d.mu.Unlock()
 
-	go func(s map[string]struct{}) {
-		for addr := range s {
+	go func() {
+		for _, n := range nodes {
 			select {
-			case d.chNode <- &node{
-				addr: addr,
-				id:   string(randBytes(20)),
-			}:
+			case d.chNode <- n:
 			case <-d.die:
 				return
 			}
 		}
-	}(seeds)
+	}()
 
-	return count
+	return len(nodes)
 }
 
 func (d *dht) peerCount() int {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	return len(d.seeds)
+	var count int
+	for _, table := range d.tables() {
+		count += table.len()
+	}
+	return count
+}
+
+// seen records a node that has just talked to us in the routing table, pinging
+// the stale node it may have to replace. rtt is zero unless the node answered
+// one of our queries.
+func (d *dht) seen(id string, from net.UDPAddr, rtt time.Duration) {
+	table := d.tableFor(from.IP)
+	if table == nil || !d.checkID(id, from) {
+		return
+	}
+
+	if stale := table.insert(&node{
+		addr:     from.String(),
+		id:       id,
+		lastSeen: time.Now(),
+		rtt:      rtt,
+	}); stale != nil {
+		d.ping(stale)
+	}
 }
 
 func (d *dht) onMessage(data []byte, from net.UDPAddr) {
 	dict, err := bencode.Decode(bytes.NewBuffer(data))
 	if err != nil {
 		log.Printf("error decoding data: %v", err)
+		d.guard.strike(from.IP, "undecodable packet")
 		return
 	}
 
 	y, ok := dict["y"].(string)
 	if !ok {
+		d.guard.strike(from.IP, "message without type")
 		return
 	}
 
 	switch y {
 	case "q":
 		d.onQuery(dict, from)
-	case "r", "e":
+	case "r":
 		d.onReply(dict, from)
+	case "e":
+		d.onError(dict, from)
 	}
 }
 
@@ -302,48 +603,236 @@ func (d *dht) onQuery(dict map[string]interface{}, from net.UDPAddr) {
 	if !ok {
 		return
 	}
+	d.counters.queries.Add(1)
+
+	if a, ok := dict["a"].(map[string]interface{}); ok {
+		if id, ok := a["id"].(string); ok {
+			d.seen(id, from, 0)
+		}
+	}
 
 	if handle, ok := d.queryTypes[q]; ok {
 		handle(dict, from)
 	}
 }
 
-func (d *dht) onReply(dict map[string]interface{} /* from */, _ net.UDPAddr) {
+func (d *dht) onReply(dict map[string]interface{}, from net.UDPAddr) {
+	tid, ok := dict["t"].(string)
+	if !ok {
+		return
+	}
+
 	r, ok := dict["r"].(map[string]interface{})
 	if !ok {
 		return
 	}
 
-	nodes, ok := r["nodes"].(string)
+	// drop anything which is not the answer to one of our queries
+	tx := d.transactions.finish(tid, from)
+	if tx == nil {
+		return
+	}
+	d.counters.replies.Add(1)
+
+	if id, ok := r["id"].(string); ok {
+		d.seen(id, from, time.Since(tx.sent))
+	}
+
+	if ip, ok := dict["ip"].(string); ok {
+		d.voteExternalIP(ip, from)
+	}
+
+	if tx.onReply != nil {
+		tx.onReply(r)
+	}
+
+	// samples are only worth anything in the reply to a sample_infohashes
+	if tx.query == "sample_infohashes" {
+		d.onSamples(r, from)
+	}
+
+	if nodes, ok := r["nodes"].(string); ok && d.conn != nil {
+		d.addFriends(decodeNodes(nodes))
+	}
+
+	if nodes6, ok := r["nodes6"].(string); ok && d.conn6 != nil {
+		d.addFriends(decodeNodes6(nodes6))
+	}
+}
+
+func (d *dht) onError(dict map[string]interface{}, from net.UDPAddr) {
+	tid, ok := dict["t"].(string)
 	if !ok {
 		return
 	}
 
-	for _, node := range decodeNodes(nodes) {
+	tx := d.transactions.finish(tid, from)
+	if tx == nil {
+		return
+	}
+
+	var code int64
+	var msg string
+	if e, ok := dict["e"].([]interface{}); ok && len(e) == 2 {
+		code, _ = e[0].(int64)
+		msg, _ = e[1].(string)
+	}
+	log.Printf("error %d from %s in reply to %s: %s", code, from.String(), tx.query, msg)
+
+	// 204 is "Method Unknown": the node does not support BEP 51
+	if tx.query == "sample_infohashes" && code == 204 {
+		d.sampleAfter(from.String(), maxSampleInterval)
+	}
+
+	if tx.onFailure != nil {
+		tx.onFailure()
+	}
+}
+
+// query sends a query and tracks it as an outstanding transaction until the
+// reply arrives or it times out. tx may carry the expected node ID and
+// callbacks, or be nil.
+func (d *dht) query(to net.UDPAddr, q string, a map[string]interface{}, tx *transaction) {
+	if tx == nil {
+		tx = &transaction{}
+	}
+	tx.query = q
+	tx.to = to
+
+	tid, ok := d.transactions.add(tx)
+	if !ok {
+		return
+	}
+
+	d.send(makeQuery(tid, q, a), to)
+}
+
+// expireTransactions counts a failure against every node which has not
+// answered in time.
+func (d *dht) expireTransactions() {
+	for _, tx := range d.transactions.expire() {
+		if tx.id != "" {
+			if table := d.tableFor(tx.to.IP); table != nil {
+				table.failed(tx.id)
+			}
+		}
+
+		if tx.onFailure != nil {
+			tx.onFailure()
+		}
+	}
+}
+
+func (d *dht) addFriends(nodes []*node) {
+	for _, node := range nodes {
 		if !d.friendsLimiter.Allow() {
 			continue
 		}
 
 		d.chNode <- node
-
-		d.mu.Lock()
-		d.seeds[node.addr] = struct{}{}
-		d.mu.Unlock()
 	}
 }
 
 func (d *dht) findNode(to string, target nodeID) {
-	q := makeQuery(string(randBytes(2)), "find_node", map[string]interface{}{
-		"id":     string(neighborID(target, d.localID)),
+	addr, err := net.ResolveUDPAddr("udp", to)
+	if err != nil {
+		return
+	}
+
+	d.query(*addr, "find_node", map[string]interface{}{
+		"id":     d.idFor(target),
 		"target": string(randBytes(20)),
-	})
+		"want":   d.want(),
+	}, &transaction{id: string(target)})
+}
 
+// findNodeTarget asks the node at to for the nodes closest to target, using
+// our real ID so that the answer can be used to fill our routing table.
+func (d *dht) findNodeTarget(to string, target nodeID) {
 	addr, err := net.ResolveUDPAddr("udp", to)
 	if err != nil {
 		return
 	}
 
-	d.send(q, *addr)
+	d.query(*addr, "find_node", map[string]interface{}{
+		"id":     string(d.id()),
+		"target": string(target),
+		"want":   d.want(),
+	}, nil)
+}
+
+// ping checks that n is still alive. A node that does not answer is counted
+// as failed and eventually evicted.
+func (d *dht) ping(n *node) {
+	addr, err := net.ResolveUDPAddr("udp", n.addr)
+	if err != nil {
+		return
+	}
+
+	d.query(*addr, "ping", map[string]interface{}{
+		"id": string(d.id()),
+	}, &transaction{id: n.id})
+}
+
+// closestNodes adds to reply the "nodes" and "nodes6" asked for by the query
+// arguments a, holding our nodes closest to target.
+func (d *dht) closestNodes(reply map[string]interface{}, a map[string]interface{}, target nodeID, from net.UDPAddr) {
+	n4, n6 := wants(a, from)
+	if n4 && d.table != nil {
+		reply["nodes"] = encodeNodes(d.table.closest(target, bucketSize), net.IPv4len)
+	}
+	if n6 && d.table6 != nil {
+		reply["nodes6"] = encodeNodes(d.table6.closest(target, bucketSize), net.IPv6len)
+	}
+}
+
+func (d *dht) onPingQuery(dict map[string]interface{}, from net.UDPAddr) {
+	tid, ok := dict["t"].(string)
+	if !ok {
+		return
+	}
+
+	a, ok := dict["a"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	id, ok := a["id"].(string)
+	if !ok {
+		return
+	}
+
+	d.reply(tid, map[string]interface{}{
+		"id": d.idFor([]byte(id)),
+	}, from)
+}
+
+func (d *dht) onFindNodeQuery(dict map[string]interface{}, from net.UDPAddr) {
+	tid, ok := dict["t"].(string)
+	if !ok {
+		return
+	}
+
+	a, ok := dict["a"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	id, ok := a["id"].(string)
+	if !ok {
+		return
+	}
+
+	target, ok := a["target"].(string)
+	if !ok || len(target) != 20 {
+		return
+	}
+
+	reply := map[string]interface{}{
+		"id": d.idFor([]byte(id)),
+	}
+	d.closestNodes(reply, a, nodeID(target), from)
+	d.reply(tid, reply, from)
 }
 
 func (d *dht) onGetPeersQuery(dict map[string]interface{}, from net.UDPAddr) {
@@ -362,12 +851,20 @@ func (d *dht) onGetPeersQuery(dict map[string]interface{}, from net.UDPAddr) {
 		return
 	}
 
-	r := makeReply(tid, map[string]interface{}{
-		"id":    string(neighborID([]byte(id), d.localID)),
-		"nodes": "",
+	infohash, ok := a["info_hash"].(string)
+	if !ok || len(infohash) != 20 {
+		return
+	}
+
+	reply := map[string]interface{}{
+		"id":    d.idFor([]byte(id)),
 		"token": d.makeToken(from),
-	})
-	d.send(r, from)
+	}
+	d.closestNodes(reply, a, nodeID(infohash), from)
+	d.reply(tid, reply, from)
+
+	// someone wants this torrent, so it is worth fetching ourselves
+	d.resolve(infohash, from)
 }
 
 func (d *dht) onAnnouncePeerQuery(dict map[string]interface{}, from net.UDPAddr) {
@@ -384,10 +881,19 @@ func (d *dht) onAnnouncePeerQuery(dict map[string]interface{}, from net.UDPAddr)
 
 	token, ok := a["token"].(string)
 	if !ok || !d.validateToken(token, from) {
+		d.guard.strike(from.IP, "announce_peer with invalid token")
 		return
 	}
 
-	if ac := d.summarize(dict, from); ac != nil {
+	ac := d.summarize(dict, from)
+	if ac == nil {
+		d.guard.strike(from.IP, "malformed announce_peer")
+		return
+	}
+
+	// a replay runs faster than the wall clock the limit goes by
+	if d.replay || d.guard.allowAnnounce(from.IP) {
+		d.counters.announces.Add(1)
 		d.announcements.put(ac)
 	}
 }
@@ -403,27 +909,57 @@ func (d *dht) summarize(dict map[string]interface{}, from net.UDPAddr) *announce
 		return nil
 	}
 
+	// v2 infohashes are truncated in the DHT, but be lenient with full ones
+	infohash, ok = truncateInfohash(infohash)
+	if !ok {
+		return nil
+	}
+
 	port := int64(from.Port)
 	if impliedPort, ok := a["implied_port"].(int64); ok && impliedPort == 0 {
 		if p, ok := a["port"].(int64); ok {
 			port = p
 		}
 	}
+	if port <= 0 || port > 65535 {
+		return nil
+	}
+
+	ip := from.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
 
 	return &announcement{
 		raw:         dict,
 		from:        from,
 		infohash:    []byte(infohash),
 		infohashHex: hex.EncodeToString([]byte(infohash)),
-		peer:        &net.TCPAddr{IP: from.IP, Port: int(port)},
+		peers:       []net.Addr{&net.TCPAddr{IP: ip, Port: int(port), Zone: from.Zone}},
 	}
 }
 
+// reply sends a reply, telling the node the address we see it at as BEP 42
+// asks.
+func (d *dht) reply(tid string, r map[string]interface{}, to net.UDPAddr) {
+	reply := makeReply(tid, r)
+	reply["ip"] = encodeAddr(to)
+	d.send(reply, to)
+}
+
 func (d *dht) send(dict map[string]interface{}, to net.UDPAddr) error {
+	conn := d.conn
+	if !isIPv4(to.IP) {
+		conn = d.conn6
+	}
+	if conn == nil {
+		return nil
+	}
+
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.conn.WriteToUDP(bencode.Encode(dict), &to)
+	conn.WriteTo(bencode.Encode(dict), &to)
 	return nil
 }
 
@@ -431,7 +967,11 @@ func (d *dht) makeFriends() {
 	for {
 		select {
 		case node := <-d.chNode:
-			d.findNode(node.addr, []byte(node.id))
+			if d.sample && d.canSample(node.addr) {
+				d.sampleInfohashes(node.addr, []byte(node.id))
+			} else {
+				d.findNode(node.addr, []byte(node.id))
+			}
 		case <-d.die:
 			return
 		}
@@ -446,5 +986,6 @@ func (d *dht) makeToken(from net.UDPAddr) string {
 }
 
 func (d *dht) validateToken(token string, from net.UDPAddr) bool {
-	return token == d.makeToken(from)
+	// recorded tokens were made with the secret of another process
+	return d.replay || token == d.makeToken(from)
 }
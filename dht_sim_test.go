@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marksamman/bencode"
+)
+
+// simulation runs a crawler among honest and malicious DHT nodes on a
+// simNetwork, with the honest nodes announcing random infohashes, and reports
+// how well the crawler bootstraps and captures announces.
+type simulation struct {
+	network   *simNetwork
+	crawler   *dht
+	honest    []*dht
+	malicious []*simConn
+
+	mu        sync.Mutex
+	announced map[string]struct{}
+	captured  map[string]struct{}
+}
+
+// simAddr returns the address of the i-th simulated node, each in its own /24
+// so that the subnet rate limits do not lump nodes together.
+func simAddr(i int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, byte(i>>8), byte(i), 1), Port: 6881}
+}
+
+// simDuration is how long TestSimulation runs the network.
+const simDuration = 20 * time.Second
+
+func newSimulation(network *simNetwork, nodes, malicious int) (*simulation, error) {
+	s := &simulation{
+		network:   network,
+		announced: make(map[string]struct{}),
+		captured:  make(map[string]struct{}),
+	}
+
+	seed := []*node{{addr: simAddr(0).String()}}
+	for i := 0; i < nodes; i++ {
+		conn, err := network.listen(simAddr(i))
+		if err != nil {
+			return nil, err
+		}
+
+		var bootstrap []*node
+		if i > 0 {
+			bootstrap = seed
+		}
+
+		d, err := newDHT(dhtConfig{
+			laddr:            conn.LocalAddr().String(),
+			maxFriendsPerSec: 10,
+			bootstrap:        bootstrap,
+			conn:             conn,
+			maxPacketsPerIP:  50,
+			maxPacketsPerNet: 200,
+		})
+		if err != nil {
+			return nil, err
+		}
+		s.honest = append(s.honest, d)
+	}
+
+	conn, err := network.listen(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 6881})
+	if err != nil {
+		return nil, err
+	}
+	s.crawler, err = newDHT(dhtConfig{
+		laddr:            conn.LocalAddr().String(),
+		maxFriendsPerSec: 100,
+		bootstrap:        seed,
+		conn:             conn,
+		maxPacketsPerIP:  50,
+		maxPacketsPerNet: 200,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < malicious; i++ {
+		conn, err := network.listen(&net.UDPAddr{IP: net.IPv4(203, 0, byte(i>>8), byte(i)), Port: 6881})
+		if err != nil {
+			return nil, err
+		}
+		s.malicious = append(s.malicious, conn)
+	}
+
+	return s, nil
+}
+
+func (s *simulation) run(duration time.Duration, announcesPerSec int) {
+	for _, d := range s.honest {
+		d.run()
+	}
+	s.crawler.run()
+
+	go s.capture()
+	for i, conn := range s.malicious {
+		if i%2 == 0 {
+			go s.flood(conn)
+		} else {
+			go s.poison(conn)
+		}
+	}
+
+	announceTicker := time.NewTicker(time.Second / time.Duration(announcesPerSec))
+	defer announceTicker.Stop()
+
+	deadline := time.After(duration)
+	for {
+		select {
+		case <-announceTicker.C:
+			s.announce(s.honest[rand.Intn(len(s.honest))])
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// capture drains the announcements of the crawler, which torsniff.run would
+// turn into metadata fetches.
+func (s *simulation) capture() {
+	for {
+		select {
+		case <-s.crawler.announcements.wait():
+			for ac := s.crawler.announcements.get(); ac != nil; ac = s.crawler.announcements.get() {
+				s.mu.Lock()
+				s.captured[ac.infohashHex] = struct{}{}
+				s.mu.Unlock()
+			}
+		case <-s.crawler.die:
+			return
+		}
+	}
+}
+
+// announce makes d announce a random infohash the way a client does: a
+// get_peers to the closest nodes it knows for a token, then an announce_peer.
+func (s *simulation) announce(d *dht) {
+	infohash := string(randBytes(20))
+
+	s.mu.Lock()
+	s.announced[hex.EncodeToString([]byte(infohash))] = struct{}{}
+	s.mu.Unlock()
+
+	for _, n := range d.table.closest(nodeID(infohash), bucketSize) {
+		addr, err := net.ResolveUDPAddr("udp", n.addr)
+		if err != nil {
+			continue
+		}
+
+		d.query(*addr, "get_peers", map[string]interface{}{
+			"id":        string(d.id()),
+			"info_hash": infohash,
+		}, &transaction{onReply: func(r map[string]interface{}) {
+			token, ok := r["token"].(string)
+			if !ok {
+				return
+			}
+			d.query(*addr, "announce_peer", map[string]interface{}{
+				"id":           string(d.id()),
+				"info_hash":    infohash,
+				"port":         6881,
+				"implied_port": 1,
+				"token":        token,
+			}, nil)
+		}})
+	}
+}
+
+// flood sends the crawler garbage and announces with bogus tokens, which
+// should get the node banned.
+func (s *simulation) flood(conn *simConn) {
+	to := s.crawler.conn.LocalAddr()
+	id := string(randBytes(20))
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := conn.WriteTo([]byte("garbage"), to); err != nil {
+			return
+		}
+		conn.WriteTo(bencode.Encode(makeQuery(string(randBytes(2)), "announce_peer", map[string]interface{}{
+			"id":        id,
+			"info_hash": string(randBytes(20)),
+			"port":      6881,
+			"token":     string(randBytes(20)),
+		})), to)
+	}
+}
+
+// poison gets into the routing table of the crawler with a ping and answers
+// its queries with nodes nobody listens on.
+func (s *simulation) poison(conn *simConn) {
+	to := s.crawler.conn.LocalAddr()
+	id := string(randBytes(20))
+
+	conn.WriteTo(bencode.Encode(makeQuery(string(randBytes(2)), "ping", map[string]interface{}{
+		"id": id,
+	})), to)
+
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		dict, err := bencode.Decode(bytes.NewBuffer(buf[:n]))
+		if err != nil {
+			continue
+		}
+		tid, ok := dict["t"].(string)
+		if !ok || dict["y"] != "q" {
+			continue
+		}
+
+		var fake []*node
+		for i := 0; i < bucketSize; i++ {
+			addr := &net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(rand.Intn(256))), Port: 6881}
+			fake = append(fake, &node{id: string(randBytes(20)), addr: addr.String()})
+		}
+		conn.WriteTo(bencode.Encode(makeReply(tid, map[string]interface{}{
+			"id":    id,
+			"nodes": encodeNodes(fake, net.IPv4len),
+		})), from)
+	}
+}
+
+// captures returns the number of infohashes announced and how many of them
+// the crawler learnt, either from an announce_peer or from a get_peers, which
+// it resolves into announcements with a lookup of its own.
+func (s *simulation) captures() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	captured := 0
+	for infohashHex := range s.announced {
+		_, ok := s.captured[infohashHex]
+		if ok || s.crawler.harvested.has(infohashHex) {
+			captured++
+		}
+	}
+	return len(s.announced), captured
+}
+
+// converged returns the number of honest nodes whose routing table holds at
+// least a bucket of nodes, and the average size of their tables.
+func (s *simulation) converged() (int, float64) {
+	var count, total int
+	for _, d := range s.honest {
+		n := d.peerCount()
+		total += n
+		if n >= bucketSize {
+			count++
+		}
+	}
+	return count, float64(total) / float64(len(s.honest))
+}
+
+func (s *simulation) report(w io.Writer) {
+	announced, captured := s.captures()
+
+	converged, avg := s.converged()
+	stats := s.crawler.stats()
+
+	fmt.Fprintf(w, "crawler nodes: %d, honest nodes converged: %d/%d (avg %.1f nodes), announces received: %d, captured: %d/%d, bans: %d, timeouts: %d, packets sent: %d, lost: %d, undeliverable: %d\n",
+		stats.Nodes, converged, len(s.honest), avg, stats.Announces, captured, announced, stats.Bans, stats.Timeouts,
+		s.network.sent.Load(), s.network.lost.Load(), s.network.undeliverable.Load())
+}
+
+// check returns what the crawler failed at, if anything.
+func (s *simulation) check() error {
+	announced, captured := s.captures()
+
+	converged, _ := s.converged()
+	stats := s.crawler.stats()
+
+	switch {
+	case stats.Nodes < bucketSize:
+		return fmt.Errorf("crawler did not bootstrap: %d nodes", stats.Nodes)
+	case converged < len(s.honest)/2:
+		return fmt.Errorf("routing did not converge: %d/%d honest nodes with a full bucket", converged, len(s.honest))
+	case announced > 0 && captured == 0:
+		return fmt.Errorf("none of %d announces captured", announced)
+	case (len(s.malicious)+1)/2 > int(stats.Bans):
+		return fmt.Errorf("only %d of %d flooding nodes banned", stats.Bans, (len(s.malicious)+1)/2)
+	}
+	return nil
+}
+
+func (s *simulation) close() {
+	for _, d := range append([]*dht{s.crawler}, s.honest...) {
+		d.conn.Close()
+	}
+	for _, conn := range s.malicious {
+		conn.Close()
+	}
+}
+
+// TestSimulation runs the crawler among honest nodes announcing infohashes and
+// malicious ones flooding it or poisoning its routing table, on a lossy
+// in-memory network, and checks that it bootstraps, that routing converges,
+// that it captures announces and that it bans the flooders.
+func TestSimulation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the simulation takes a while")
+	}
+
+	// the nodes log every query
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	s, err := newSimulation(newSimNetwork(20*time.Millisecond, 10*time.Millisecond, 0.02), 200, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	s.run(simDuration, 20)
+
+	var report bytes.Buffer
+	s.report(&report)
+	t.Log(report.String())
+
+	if err := s.check(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// fetchParallel is the number of peers of an infohash fetched from at once.
+	fetchParallel = 4
+	// dialTimeout is how long a peer has to accept the connection, well
+	// below the timeout of the whole exchange so that dead peers fail fast.
+	dialTimeout = 5 * time.Second
+	// fetchRounds bounds a whole fetch to that many timeouts of a single
+	// peer, however many candidates keep coming in.
+	fetchRounds = 4
+)
+
+var errNoPeers = errors.New("no peer to fetch from")
+
+type fetchResult struct {
+	peer   string
+	meta   []byte
+	err    error
+	dialed bool   // the peer accepted the connection
+	via    string // the transport it accepted, "tcp" or "utp"
+
+	encrypted bool // with MSE and RC4
+	fellBack  bool // to plaintext, after a failed MSE handshake
+
+	// what the peer told about itself
+	peerID string
+	client string
+	reqq   int
+	yourIP net.IP
+}
+
+// transportStats counts over which transport the peers were reached.
+type transportStats struct {
+	tcpConnects    atomic.Uint64
+	utpConnects    atomic.Uint64
+	tcpFetches     atomic.Uint64 // metadata fetched over TCP
+	utpFetches     atomic.Uint64 // metadata fetched over uTP
+	failedConnects atomic.Uint64 // peers reachable over neither
+	encrypted      atomic.Uint64 // connections encrypted with MSE and RC4
+	fallbacks      atomic.Uint64 // plaintext reconnections after a failed MSE handshake
+	pexPeers       atomic.Uint64 // candidates learnt from PEX
+}
+
+// transportSnapshot is the snapshot of transportStats served over HTTP.
+type transportSnapshot struct {
+	TCPConnects    uint64 `json:"tcpConnects"`
+	UTPConnects    uint64 `json:"utpConnects"`
+	TCPFetches     uint64 `json:"tcpFetches"`
+	UTPFetches     uint64 `json:"utpFetches"`
+	FailedConnects uint64 `json:"failedConnects"`
+	Encrypted      uint64 `json:"encrypted"`
+	Fallbacks      uint64 `json:"fallbacks"`
+	PexPeers       uint64 `json:"pexPeers"`
+}
+
+func (s *transportStats) snapshot() transportSnapshot {
+	return transportSnapshot{
+		TCPConnects:    s.tcpConnects.Load(),
+		UTPConnects:    s.utpConnects.Load(),
+		TCPFetches:     s.tcpFetches.Load(),
+		UTPFetches:     s.utpFetches.Load(),
+		FailedConnects: s.failedConnects.Load(),
+		Encrypted:      s.encrypted.Load(),
+		Fallbacks:      s.fallbacks.Load(),
+		PexPeers:       s.pexPeers.Load(),
+	}
+}
+
+func (s *transportStats) count(r fetchResult) {
+	if r.encrypted {
+		s.encrypted.Add(1)
+	}
+	if r.fellBack {
+		s.fallbacks.Add(1)
+	}
+
+	switch {
+	case !r.dialed:
+		s.failedConnects.Add(1)
+	case r.via == "utp":
+		s.utpConnects.Add(1)
+		if r.err == nil {
+			s.utpFetches.Add(1)
+		}
+	default:
+		s.tcpConnects.Add(1)
+		if r.err == nil {
+			s.tcpFetches.Add(1)
+		}
+	}
+}
+
+// fetch downloads the metadata of ac from its peers, fetchParallel at once,
+// taking in the peers which announce it meanwhile. A peer which does not
+// accept the connection is blacklisted right away, one which does gets up to
+// maxRetries attempts, after the other candidates. The peers the candidates
+// tell us about over PEX become candidates too, and are returned with whether
+// they are seeds, along with the result of the peer which gave the metadata.
+// It gives up with errTimeout after fetchRounds timeouts, or once ctx is done.
+func (t *torsniff) fetch(ctx context.Context, ac *announcement) (fetchResult, map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchRounds*t.timeout)
+	defer cancel()
+
+	more, stop := t.announcements.follow(ac.infohashHex)
+	defer stop()
+
+	var queue []string
+	attempts := make(map[string]int)
+	enqueue := func(peers []net.Addr) {
+		for _, peer := range peers {
+			addr := peer.String()
+			if len(attempts) >= maxFetchCandidates {
+				return
+			}
+			if _, ok := attempts[addr]; !ok && !t.blacklist.has(addr) {
+				attempts[addr] = 0
+				queue = append(queue, addr)
+			}
+		}
+	}
+	enqueue(ac.peers)
+
+	pex := make(map[string]bool)
+	pexPeers := make(chan []pexPeer, fetchParallel)
+
+	// buffered so that the attempts still running when we return can finish
+	results := make(chan fetchResult, fetchParallel)
+	running := 0
+	err := errNoPeers
+
+	for {
+		for running < fetchParallel && len(queue) > 0 {
+			peer := queue[0]
+			queue = queue[1:]
+
+			attempts[peer]++
+			running++
+			go func() {
+				results <- t.fetchFrom(ctx, ac, peer, pexPeers)
+			}()
+		}
+
+		if running == 0 {
+			return fetchResult{}, pex, err
+		}
+
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				return r, pex, nil
+			}
+			err = r.err
+			log.Printf("Attempt %d to fetch meta failed for peer %s: %v", attempts[r.peer], r.peer, r.err)
+
+			if r.dialed && attempts[r.peer] < t.maxRetries {
+				queue = append(queue, r.peer)
+				continue
+			}
+			log.Printf("adding peer %s to blacklist after %d failed attempts", r.peer, attempts[r.peer])
+			t.blacklist.add(r.peer)
+		case peers := <-more:
+			enqueue(peers)
+		case peers := <-pexPeers:
+			addrs := make([]net.Addr, 0, len(peers))
+			for _, p := range peers {
+				addr := p.addr.String()
+				if _, ok := pex[addr]; !ok {
+					t.transports.pexPeers.Add(1)
+				}
+				pex[addr] = pex[addr] || p.seed
+				addrs = append(addrs, p.addr)
+			}
+			enqueue(addrs)
+		case <-ctx.Done():
+			return fetchResult{}, pex, errTimeout
+		}
+	}
+}
+
+// fetchFrom fetches the metadata of ac from peer, passing on the peers it
+// sends over PEX meanwhile.
+func (t *torsniff) fetchFrom(ctx context.Context, ac *announcement, peer string, pex chan<- []pexPeer) fetchResult {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	wire := newMetaWire(string(ac.infohash), peer, t.timeout)
+	wire.utp = t.utp
+	wire.encryption = t.encryption
+	wire.onPex = func(peers []pexPeer) {
+		select {
+		case pex <- peers:
+		default:
+			// fetch is busy or gone, PEX messages come again
+		}
+	}
+	defer wire.free()
+
+	meta, err := wire.fetchCtx(ctx)
+	r := fetchResult{
+		peer:      peer,
+		meta:      meta,
+		err:       err,
+		dialed:    wire.conn != nil,
+		via:       wire.via,
+		encrypted: wire.encrypted,
+		fellBack:  wire.fellBack,
+		peerID:    wire.remoteID,
+		client:    wire.client,
+		reqq:      wire.reqq,
+		yourIP:    wire.yourIP,
+	}
+	t.transports.count(r)
+	t.clients.count(r)
+	return r
+}
@@ -0,0 +1,37 @@
+import React, { useEffect, useState } from 'react';
+
+const isImage = (name: string) => /\.(jpe?g|png|gif|webp)$/i.test(name);
+
+const FilePreview: React.FC<{ hash: string; name: string }> = ({ hash, name }) => {
+  const [text, setText] = useState<string | null>(null);
+  const url = `/torrent/preview?h=${hash}&file=${encodeURIComponent(name)}`;
+
+  useEffect(() => {
+    if (isImage(name)) return;
+
+    let cancelled = false;
+    setText(null);
+    fetch(url)
+      .then((response) => (response.ok ? response.text() : Promise.reject(response.statusText)))
+      .then((body) => !cancelled && setText(body))
+      .catch(() => !cancelled && setText('Preview not available'));
+    return () => {
+      cancelled = true;
+    };
+  }, [url]);
+
+  return (
+    <div className="mb-3">
+      <h6 className="text-break">{name}</h6>
+      {isImage(name) ? (
+        <img src={url} alt={name} className="img-fluid" />
+      ) : (
+        <pre className="border p-2" style={{ maxHeight: '20em', overflow: 'auto', fontFamily: 'monospace', lineHeight: 1 }}>
+          {text ?? 'Loading preview...'}
+        </pre>
+      )}
+    </div>
+  );
+};
+
+export default FilePreview;
@@ -2,6 +2,7 @@ import React, { Suspense } from 'react';
 import { formatBytes } from './utils';
 
 const FileTree = React.lazy(() => import('./FileTree'));
+const FilePreview = React.lazy(() => import('./FilePreview'));
 
 interface TorrentDetailsModalProps {
   selectedTorrent: any;
@@ -26,15 +27,33 @@ const TorrentDetailsModal: React.FC<TorrentDetailsModalProps> = ({
           <div className="modal-body">
             <p>Name: {selectedTorrent.name}</p>
             <p>Size: {formatBytes(selectedTorrent.length)}</p>
+            {selectedTorrent.infohashV1 && <p className="text-break">Infohash v1: {selectedTorrent.infohashV1}</p>}
+            {selectedTorrent.infohashV2 && <p className="text-break">Infohash v2: {selectedTorrent.infohashV2}</p>}
+            {selectedTorrent.scrapedAt && (
+              <p>
+                Swarm: {selectedTorrent.seeders} seeders, {selectedTorrent.leechers} leechers
+                (as of {new Date(selectedTorrent.scrapedAt).toLocaleString()})
+              </p>
+            )}
             <p>
               Links: 
-              <a href={`magnet:?xt=urn:btih:${selectedTorrent.infohashHex}`} className="btn btn-primary" target="_blank" rel="noopener noreferrer">
+              <a href={selectedTorrent.magnet || `magnet:?xt=urn:btih:${selectedTorrent.infohashHex}`} className="btn btn-primary" target="_blank" rel="noopener noreferrer">
                 {"🧲"}
               </a>
               <a href={`/torrentfile?h=${selectedTorrent.infohashHex}`} className="btn btn-primary" download>
                 📥
               </a>
             </p>
+            {selectedTorrent.previews && selectedTorrent.previews.length > 0 && (
+              <>
+                <h3>Previews:</h3>
+                <Suspense fallback={<div>Loading previews...</div>}>
+                  {selectedTorrent.previews.map((name: string) => (
+                    <FilePreview key={name} hash={selectedTorrent.infohashHex} name={name} />
+                  ))}
+                </Suspense>
+              </>
+            )}
             <h3>Files:</h3>
             <div className="files-section">
               <Suspense fallback={<div>Loading files...</div>}>
@@ -15,11 +15,13 @@ const App: React.FC = () => {
   const [showModal, setShowModal] = useState(false);
   const [showDeleteModal, setShowDeleteModal] = useState(false);
   const [torrentToDelete, setTorrentToDelete] = useState<string | null>(null);
+  const [sort, setSort] = useState('');
+  const [minSeeders, setMinSeeders] = useState(0);
 
   const fetchResults = async () => {
     try {
       const endpoint = isSearching ? `/query?q=${query}` : '/all?';
-      const response = await fetch(`${endpoint}&f=${page * size}&s=${size}`);
+      const response = await fetch(`${endpoint}&f=${page * size}&s=${size}&sort=${sort}&minSeeders=${minSeeders}`);
       if (!response.ok) throw new Error('Failed to fetch');
       const data = await response.json();
       // Check if torrents is null and set results accordingly
@@ -49,7 +51,7 @@ const App: React.FC = () => {
 
   useEffect(() => {
     fetchResults();
-  }, [page]); // Fetch results when the page changes
+  }, [page, sort, minSeeders]); // Fetch results when the page or the ordering changes
 
   const handleSearch = () => {
     setIsSearching(true);
@@ -118,11 +120,29 @@ const App: React.FC = () => {
         <button className="btn btn-primary" onClick={handleSearch}>Search</button>
         <button className="btn btn-secondary" onClick={handleAll}>Get All Torrents</button>
       </div>
+      <div className="input-group mb-3">
+        <span className="input-group-text">Sort by</span>
+        <select className="form-select" value={sort} onChange={(e) => { setSort(e.target.value); setPage(0); }}>
+          <option value="">Relevance</option>
+          <option value="-seeders">Most seeders</option>
+          <option value="-leechers">Most leechers</option>
+          <option value="-length">Largest</option>
+        </select>
+        <span className="input-group-text">Min seeders</span>
+        <input
+          type="number"
+          min={0}
+          className="form-control"
+          value={minSeeders}
+          onChange={(e) => { setMinSeeders(Math.max(0, parseInt(e.target.value) || 0)); setPage(0); }}
+        />
+      </div>
       {error && <p className="text-danger">{error}</p>}
       <ul className="list-group mb-3">
         {results && results.map((torrent: any) => (
           <li key={torrent.infohashHex} className="list-group-item d-flex justify-content-between align-items-center">
             {torrent.name} - {formatBytes(torrent.length)}
+            {torrent.scrapedAt && ` - ${torrent.seeders} seeders, ${torrent.leechers} leechers`}
             <div>
               <button className="btn btn-link" onClick={() => handleTorrent(torrent.infohashHex)}>Details</button>
             </div>
@@ -13,12 +13,19 @@ import (
 	"strings"
 
 	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
 	"github.com/marksamman/bencode"
 )
 
 //go:embed static/*
 var staticFiles embed.FS
 
+type statsResponse struct {
+	Identities []identityStats   `json:"identities"`
+	Queue      queueStats        `json:"queue"`
+	Transports transportSnapshot `json:"transports"`
+}
+
 type searchResponse struct {
 	SearchResults *bleve.SearchResult `json:"search"`
 	Torrents      []*torrent          `json:"torrents"`
@@ -41,6 +48,8 @@ func getTorrentsFromSearch(searchResults *bleve.SearchResult) []*torrent {
 			log.Println(err)
 			continue
 		}
+		torrent.loadSwarm()
+		torrent.loadPreviews()
 
 		torrents = append(torrents, torrent)
 	}
@@ -64,13 +73,41 @@ func getQSInt(qs url.Values, key string, defaultValue int) int {
 
 }
 
+// sortFields are the fields search results may be sorted by, descending if
+// prefixed with -.
+var sortFields = map[string]bool{
+	"seeders":   true,
+	"leechers":  true,
+	"length":    true,
+	"scrapedAt": true,
+}
+
+// newSwarmSearchRequest makes a search request for q, keeping only torrents
+// with at least minSeeders seeders and sorted by the sort field if given.
+func newSwarmSearchRequest(q query.Query, qs url.Values) *bleve.SearchRequest {
+	if minSeeders := getQSInt(qs, "minSeeders", 0); minSeeders > 0 {
+		min := float64(minSeeders)
+		seeders := bleve.NewNumericRangeQuery(&min, nil)
+		seeders.SetField("seeders")
+		q = bleve.NewConjunctionQuery(q, seeders)
+	}
+
+	searchRequest := bleve.NewSearchRequest(q)
+
+	searchRequest.From = getQSInt(qs, "f", searchRequest.From)
+	searchRequest.Size = getQSInt(qs, "s", searchRequest.Size)
+
+	if sort := qs.Get("sort"); sortFields[strings.TrimPrefix(sort, "-")] {
+		searchRequest.SortBy([]string{sort, "-_score"})
+	}
+
+	return searchRequest
+}
+
 func allHandler(w http.ResponseWriter, r *http.Request) {
 
 	query := bleve.NewMatchAllQuery()
-	searchRequest := bleve.NewSearchRequest(query)
-
-	searchRequest.From = getQSInt(r.URL.Query(), "f", searchRequest.From)
-	searchRequest.Size = getQSInt(r.URL.Query(), "s", searchRequest.Size)
+	searchRequest := newSwarmSearchRequest(query, r.URL.Query())
 
 	searchResults, err := index.Search(searchRequest)
 	if err != nil {
@@ -97,10 +134,7 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 
 	// search for some text
 	query := bleve.NewQueryStringQuery(searchText)
-	searchRequest := bleve.NewSearchRequest(query)
-
-	searchRequest.From = getQSInt(r.URL.Query(), "f", searchRequest.From)
-	searchRequest.Size = getQSInt(r.URL.Query(), "s", searchRequest.Size)
+	searchRequest := newSwarmSearchRequest(query, r.URL.Query())
 
 	searchResults, err := index.Search(searchRequest)
 	if err != nil {
@@ -156,6 +190,8 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 			log.Println(err)
 			return
 		}
+		index.DeleteInternal(swarmKey(hash))
+		deletePreviews(hash)
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -183,19 +219,13 @@ func torrentFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// decode data
-	d, err := bencode.Decode(bytes.NewBuffer(meta))
+	ed, err := encodeTorrentFile(meta)
 	if err != nil {
 		http.Error(w, "Torrent not decoded", http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
 
-	// re-encode with correct format
-	ed := bencode.Encode(map[string]interface{}{
-		"info": d,
-	})
-
 	// Use the torrent name for the filename, replacing any invalid characters
 	filename := fmt.Sprintf("%s.torrent", sanitizeFilename(torrent.Name))
 
@@ -205,6 +235,20 @@ func torrentFileHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(ed)
 }
 
+// encodeTorrentFile wraps the info dictionary meta into a .torrent file.
+func encodeTorrentFile(meta []byte) ([]byte, error) {
+	// decode data
+	d, err := bencode.Decode(bytes.NewBuffer(meta))
+	if err != nil {
+		return nil, err
+	}
+
+	// re-encode with correct format
+	return bencode.Encode(map[string]interface{}{
+		"info": d,
+	}), nil
+}
+
 func countHandler(w http.ResponseWriter, r *http.Request) {
 	docCount, err := index.DocCount()
 	if err != nil {
@@ -221,6 +265,30 @@ func countHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (t *torsniff) statsHandler(w http.ResponseWriter, r *http.Request) {
+	var response statsResponse
+	for _, dht := range t.dhts {
+		response.Identities = append(response.Identities, dht.stats())
+	}
+	response.Queue = t.announcements.stats()
+	response.Transports = t.transports.snapshot()
+
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+// clientsHandler serves which clients the peers we fetched from run.
+func (t *torsniff) clientsHandler(w http.ResponseWriter, r *http.Request) {
+	err := json.NewEncoder(w).Encode(t.clients.snapshot())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
 func sanitizeFilename(name string) string {
 	// Replace any characters that are not allowed in filenames
 	return strings.Map(func(r rune) rune {
@@ -231,7 +299,7 @@ func sanitizeFilename(name string) string {
 	}, name)
 }
 
-func startHTTP(port int) {
+func startHTTP(port int, t *torsniff) {
 
 	http.HandleFunc("/query", Gzip(searchHandler))
 	http.HandleFunc("/torrent", Gzip(torrentHandler))
@@ -239,6 +307,10 @@ func startHTTP(port int) {
 	http.HandleFunc("/delete", Gzip(deleteHandler))           // Register the delete handler
 	http.HandleFunc("/count", Gzip(countHandler))             // Register the count handler
 	http.HandleFunc("/torrentfile", Gzip(torrentFileHandler)) // Register the new handler
+	http.HandleFunc("/stats", Gzip(t.statsHandler))
+	http.HandleFunc("/stats/clients", Gzip(t.clientsHandler))
+	http.HandleFunc("/resolve", Gzip(t.resolveHandler))
+	http.HandleFunc("/torrent/preview", Gzip(previewHandler))
 
 	// Create a file system from the embedded files
 	staticFS, err := fs.Sub(staticFiles, "static")
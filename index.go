@@ -6,6 +6,7 @@ import (
 	"github.com/blevesearch/bleve/v2"
 	"github.com/blevesearch/bleve/v2/analysis/analyzer/keyword"
 	"github.com/blevesearch/bleve/v2/analysis/analyzer/simple"
+	"github.com/blevesearch/bleve/v2/mapping"
 )
 
 var (
@@ -22,30 +23,7 @@ func startIndex() {
 	if err == bleve.ErrorIndexPathDoesNotExist {
 		log.Println("creating new index...")
 
-		indexMapping := bleve.NewIndexMapping()
-
-		torrentMapping := bleve.NewDocumentMapping()
-
-		// // a generic reusable mapping for english text
-		// englishTextFieldMapping := bleve.NewTextFieldMapping()
-		// englishTextFieldMapping.Analyzer = en.AnalyzerName
-
-		// simpleTextFieldMapping := bleve.NewTextFieldMapping()
-		// simpleTextFieldMapping.Analyzer = simple.Name
-
-		// a generic reusable mapping for keyword text
-		keywordFieldMapping := bleve.NewTextFieldMapping()
-		keywordFieldMapping.Analyzer = keyword.Name
-
-		// torrentMapping.AddFieldMappingsAt("Name", simpleTextFieldMapping)
-		torrentMapping.AddFieldMappingsAt("InfohashHex", keywordFieldMapping)
-
-		indexMapping.AddDocumentMapping("torrent", torrentMapping)
-
-		indexMapping.TypeField = "IndexType"
-		indexMapping.DefaultAnalyzer = simple.Name
-
-		index, err = bleve.New(indexFile, indexMapping)
+		index, err = bleve.New(indexFile, newIndexMapping())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -60,3 +38,36 @@ func startIndex() {
 	log.Printf("index contains %d documents", docCount)
 
 }
+
+func newIndexMapping() *mapping.IndexMappingImpl {
+	indexMapping := bleve.NewIndexMapping()
+
+	torrentMapping := bleve.NewDocumentMapping()
+
+	// // a generic reusable mapping for english text
+	// englishTextFieldMapping := bleve.NewTextFieldMapping()
+	// englishTextFieldMapping.Analyzer = en.AnalyzerName
+
+	// simpleTextFieldMapping := bleve.NewTextFieldMapping()
+	// simpleTextFieldMapping.Analyzer = simple.Name
+
+	// a generic reusable mapping for keyword text
+	keywordFieldMapping := bleve.NewTextFieldMapping()
+	keywordFieldMapping.Analyzer = keyword.Name
+
+	// torrentMapping.AddFieldMappingsAt("Name", simpleTextFieldMapping)
+	torrentMapping.AddFieldMappingsAt("InfohashHex", keywordFieldMapping)
+
+	indexMapping.AddDocumentMapping("torrent", torrentMapping)
+
+	indexMapping.TypeField = "IndexType"
+	indexMapping.DefaultAnalyzer = simple.Name
+
+	return indexMapping
+}
+
+// newMemIndex returns an empty index held in memory, for commands which do
+// not keep what they find.
+func newMemIndex() (bleve.Index, error) {
+	return bleve.NewMemOnly(newIndexMapping())
+}
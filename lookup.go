@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// lookupTimeout bounds how long a get_peers lookup may run.
+	lookupTimeout = 15 * time.Second
+	// maxLookupQueries bounds the number of nodes asked during one lookup.
+	maxLookupQueries = 64
+	// maxLookupPeers is the number of peers after which a lookup stops.
+	maxLookupPeers = 8
+	// lookupBranching is the number of returned nodes queried per reply.
+	lookupBranching = 3
+)
+
+// lookup is an iterative get_peers search for the peers of an infohash, or
+// for an estimate of their number if it is a BEP 33 scrape.
+type lookup struct {
+	d        *dht
+	infohash string
+	onDone   func(peers []*net.TCPAddr)
+	scrape   bool
+	onScrape func(seeders, leechers int, replied bool)
+
+	mu        sync.Mutex
+	queried   map[string]struct{}
+	replies   int
+	peers     []*net.TCPAddr
+	seenPeers map[string]struct{}
+	finished  bool
+	timer     *time.Timer
+	seeds     bloomFilter // BFsd of the replies merged
+	leechers  bloomFilter // BFpe of the replies merged
+	scraped   bool        // some node replied with a bloom filter
+}
+
+// decodePeers decodes the compact peer info of a "values" list, 6 bytes for
+// IPv4 and 18 bytes for IPv6.
+func decodePeers(values []interface{}) (peers []*net.TCPAddr) {
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok || (len(s) != 6 && len(s) != 18) {
+			continue
+		}
+
+		ipLen := len(s) - 2
+		port := int(binary.BigEndian.Uint16([]byte(s[ipLen:])))
+		if port == 0 {
+			continue
+		}
+
+		peers = append(peers, &net.TCPAddr{IP: net.IP([]byte(s[:ipLen])), Port: port})
+	}
+	return
+}
+
+// getPeers looks up the peers of infohash starting from the closest nodes of
+// our routing tables. onDone is called once with the peers found, which may
+// be none.
+func (d *dht) getPeers(infohash string, onDone func(peers []*net.TCPAddr)) {
+	d.lookup(&lookup{infohash: infohash, onDone: onDone})
+}
+
+// scrape estimates the number of seeders and leechers of infohash from the
+// bloom filters of BEP 33, which the closest nodes return in place of peers.
+// onDone is told whether any node replied with one, without which the
+// estimate is no more than an empty routing table or unreachable nodes.
+func (d *dht) scrape(infohash string, onDone func(seeders, leechers int, replied bool)) {
+	d.lookup(&lookup{infohash: infohash, scrape: true, onScrape: onDone})
+}
+
+func (d *dht) lookup(l *lookup) {
+	l.d = d
+	l.queried = make(map[string]struct{})
+	l.seenPeers = make(map[string]struct{})
+
+	var start []*node
+	for _, table := range d.tables() {
+		start = append(start, table.closest(nodeID(l.infohash), bucketSize)...)
+	}
+
+	if len(start) == 0 {
+		go l.done()
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.timer = time.AfterFunc(lookupTimeout, l.finish)
+	for _, n := range start {
+		l.queryLocked(n.addr)
+	}
+}
+
+func (l *lookup) queryLocked(addr string) {
+	if l.finished || len(l.queried) >= maxLookupQueries {
+		return
+	}
+
+	if _, ok := l.queried[addr]; ok {
+		return
+	}
+	l.queried[addr] = struct{}{}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return
+	}
+
+	a := map[string]interface{}{
+		"id":        string(l.d.id()),
+		"info_hash": l.infohash,
+		"want":      l.d.want(),
+	}
+	if l.scrape {
+		a["scrape"] = 1
+	}
+	l.d.query(*udpAddr, "get_peers", a, &transaction{onReply: l.onReply, onFailure: l.onFailure})
+}
+
+func (l *lookup) onFailure() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.finished {
+		return
+	}
+
+	l.replies++
+	if l.replies >= len(l.queried) {
+		l.finishLocked()
+	}
+}
+
+func (l *lookup) onReply(r map[string]interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.finished {
+		return
+	}
+	l.replies++
+
+	if values, ok := r["values"].([]interface{}); ok {
+		for _, peer := range decodePeers(values) {
+			if _, ok := l.seenPeers[peer.String()]; ok {
+				continue
+			}
+			l.seenPeers[peer.String()] = struct{}{}
+			l.peers = append(l.peers, peer)
+		}
+
+		if len(l.peers) >= maxLookupPeers && !l.scrape {
+			l.finishLocked()
+			return
+		}
+	}
+
+	if l.scrape {
+		if s, ok := r["BFsd"].(string); ok && l.seeds.merge(s) {
+			l.scraped = true
+		}
+		if s, ok := r["BFpe"].(string); ok && l.leechers.merge(s) {
+			l.scraped = true
+		}
+	}
+
+	var nodes []*node
+	if s, ok := r["nodes"].(string); ok && l.d.conn != nil {
+		nodes = append(nodes, decodeNodes(s)...)
+	}
+	if s, ok := r["nodes6"].(string); ok && l.d.conn6 != nil {
+		nodes = append(nodes, decodeNodes6(s)...)
+	}
+
+	target := []byte(l.infohash)
+	sort.Slice(nodes, func(i, j int) bool {
+		return bytes.Compare(distance([]byte(nodes[i].id), target), distance([]byte(nodes[j].id), target)) < 0
+	})
+
+	asked := 0
+	for _, n := range nodes {
+		if asked == lookupBranching {
+			break
+		}
+		if _, ok := l.queried[n.addr]; !ok {
+			l.queryLocked(n.addr)
+			asked++
+		}
+	}
+
+	// every node we asked has answered and none had anything new to offer
+	if l.replies >= len(l.queried) {
+		l.finishLocked()
+	}
+}
+
+func (l *lookup) finish() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.finishLocked()
+}
+
+func (l *lookup) finishLocked() {
+	if l.finished {
+		return
+	}
+	l.finished = true
+	l.timer.Stop()
+
+	go l.done()
+}
+
+func (l *lookup) done() {
+	if l.scrape {
+		l.onScrape(l.seeds.estimate(), l.leechers.estimate(), l.scraped)
+		return
+	}
+	l.onDone(l.peers)
+}
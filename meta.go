@@ -3,7 +3,6 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/sha1"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -20,12 +19,25 @@ const (
 	maxMetadataSize = perBlock * 1024
 	extended        = 20
 	extHandshake    = 0
+	// maxMessageSize bounds the messages we read, a metadata piece and its
+	// header being the largest we care about.
+	maxMessageSize = 1 << 20
+	// maxPieceRequests is how often a piece is requested before giving up.
+	maxPieceRequests = 3
+)
+
+// ut_metadata message types (BEP 9)
+const (
+	utRequest = 0
+	utData    = 1
+	utReject  = 2
 )
 
 var (
-	errExtHeader    = errors.New("invalid extension header response")
-	errInvalidPiece = errors.New("invalid piece response")
-	errTimeout      = errors.New("time out")
+	errExtHeader     = errors.New("invalid extension header response")
+	errInvalidPiece  = errors.New("invalid piece response")
+	errPieceRejected = errors.New("rejected")
+	errTimeout       = errors.New("time out")
 )
 
 var metaWirePool = sync.Pool{
@@ -38,12 +50,23 @@ type metaWire struct {
 	infohash     string
 	from         string
 	peerID       string
-	conn         *net.TCPConn
+	conn         net.Conn
+	utp          bool   // fall back to uTP if the peer does not take TCP
+	via          string // "tcp" or "utp", once connected
+	encryption   string // encryptionPrefer, encryptionRequire or encryptionDisable
+	encrypted    bool   // the connection is RC4 encrypted
+	fellBack     bool   // the MSE handshake failed and we reconnected in plaintext
 	timeout      time.Duration
 	metadataSize int
 	utMetadata   int
 	numOfPieces  int
 	pieces       [][]byte
+	requests     []int // times each piece was requested
+	onPex        func([]pexPeer)
+	remoteID     string // peer ID from the handshake
+	client       string // "v" of the extension handshake
+	reqq         int    // outstanding requests the peer takes, 0 if not told
+	yourIP       net.IP // our address as the peer sees it
 	err          error
 }
 
@@ -54,6 +77,16 @@ func newMetaWire(infohash string, from string, timeout time.Duration) *metaWire
 	w.peerID = string(randBytes(20))
 	w.timeout = timeout
 	w.conn = nil
+	w.utp = false
+	w.via = ""
+	w.encryption = encryptionDisable
+	w.encrypted = false
+	w.fellBack = false
+	w.onPex = nil
+	w.remoteID = ""
+	w.client = ""
+	w.reqq = 0
+	w.yourIP = nil
 	w.err = nil
 	return w
 }
@@ -64,16 +97,25 @@ func (mw *metaWire) fetch() ([]byte, error) {
 	return mw.fetchCtx(ctx)
 }
 
+// fetchCtx connects to the peer and fetches the metadata, giving up when ctx
+// is done. The connection is closed when it returns.
 func (mw *metaWire) fetchCtx(ctx context.Context) ([]byte, error) {
 	mw.connect(ctx)
+	if mw.err != nil {
+		return nil, mw.err
+	}
+	defer mw.close()
+
+	return mw.exchange(ctx)
+}
+
+// exchange runs the metadata exchange over the connection to the peer.
+func (mw *metaWire) exchange(ctx context.Context) ([]byte, error) {
 	mw.handshake(ctx)
 	mw.onHandshake(ctx)
 	mw.extHandshake(ctx)
 
 	if mw.err != nil {
-		if mw.conn != nil {
-			mw.conn.Close()
-		}
 		return nil, mw.err
 	}
 
@@ -83,7 +125,8 @@ func (mw *metaWire) fetchCtx(ctx context.Context) ([]byte, error) {
 			return nil, err
 		}
 
-		if data[0] != extended {
+		// keep-alives and messages other than the extension protocol
+		if len(data) < 2 || data[0] != extended {
 			continue
 		}
 
@@ -96,8 +139,7 @@ func (mw *metaWire) fetchCtx(ctx context.Context) ([]byte, error) {
 		}
 
 		m := bytes.Join(mw.pieces, []byte(""))
-		sum := sha1.Sum(m)
-		if bytes.Equal(sum[:], []byte(mw.infohash)) {
+		if verifyMetadata(m, mw.infohash) {
 			return m, nil
 		}
 
@@ -106,13 +148,86 @@ func (mw *metaWire) fetchCtx(ctx context.Context) ([]byte, error) {
 }
 
 func (mw *metaWire) connect(ctx context.Context) {
-	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", mw.from)
+	conn, via, err := mw.dial(ctx)
+	if err == nil && mw.encryption != encryptionDisable {
+		var plain net.Conn = conn
+		conn, mw.encrypted, err = mseHandshake(plain, mw.infohash, mw.encryption == encryptionPrefer)
+		if err != nil {
+			plain.Close()
+			if mw.encryption == encryptionPrefer && ctx.Err() == nil {
+				// the peer may not speak MSE, try again in plaintext
+				mw.fellBack = true
+				conn, via, err = mw.dial(ctx)
+			}
+		}
+	}
 	if err != nil {
 		mw.err = fmt.Errorf("connect to remote peer failed: %v", err)
 		return
 	}
 
-	mw.conn = conn.(*net.TCPConn)
+	mw.conn = conn
+	mw.via = via
+}
+
+// dial connects to the peer over TCP or, failing that, uTP if allowed.
+func (mw *metaWire) dial(ctx context.Context) (net.Conn, string, error) {
+	via := "tcp"
+	conn, err := (&net.Dialer{Timeout: dialTimeout}).DialContext(ctx, "tcp", mw.from)
+	if err != nil && mw.utp && ctx.Err() == nil {
+		// plenty of peers behind NATs only take uTP (BEP 29)
+		utpCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+		var utpErr error
+		conn, utpErr = dialUTP(utpCtx, mw.from)
+		cancel()
+		if utpErr != nil {
+			err = fmt.Errorf("%v, over utp: %v", err, utpErr)
+		} else {
+			via, err = "utp", nil
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return watchConn(ctx, conn), via, nil
+}
+
+// ctxConn is a connection bound to a context: reads and writes do not watch
+// ctx, so it gets the deadline of ctx and is closed as soon as ctx is done,
+// which unblocks them. A stalled or cancelled peer then holds neither a
+// goroutine nor a file descriptor past ctx.
+type ctxConn struct {
+	net.Conn
+	stop      func() bool
+	closeOnce sync.Once
+	err       error
+}
+
+func watchConn(ctx context.Context, conn net.Conn) *ctxConn {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c := &ctxConn{Conn: conn}
+	// the callback may run before AfterFunc returns, when ctx is done
+	// already, so it must not touch stop
+	c.stop = context.AfterFunc(ctx, func() {
+		c.closeConn()
+	})
+	return c
+}
+
+func (c *ctxConn) Close() error {
+	c.stop()
+	return c.closeConn()
+}
+
+func (c *ctxConn) closeConn() error {
+	c.closeOnce.Do(func() {
+		c.err = c.Conn.Close()
+	})
+	return c.err
 }
 
 func (mw *metaWire) handshake(ctx context.Context) {
@@ -166,6 +281,8 @@ func (mw *metaWire) onHandshake(ctx context.Context) {
 		mw.err = errors.New("invalid bittorrent header response")
 		return
 	}
+
+	mw.remoteID = string(res[48:68])
 }
 
 func (mw *metaWire) extHandshake(ctx context.Context) {
@@ -182,7 +299,8 @@ func (mw *metaWire) extHandshake(ctx context.Context) {
 
 	data := append([]byte{extended, extHandshake}, bencode.Encode(map[string]interface{}{
 		"m": map[string]interface{}{
-			"ut_metadata": 1,
+			"ut_metadata": utMetadataID,
+			"ut_pex":      utPexID,
 		},
 	})...)
 	if err := mw.write(ctx, data); err != nil {
@@ -203,6 +321,9 @@ func (mw *metaWire) onExtHandshake(ctx context.Context, payload []byte) error {
 		return errExtHeader
 	}
 
+	// who the peer is, whether it has the metadata or not
+	mw.onPeerInfo(dict)
+
 	metadataSize, ok := dict["metadata_size"].(int64)
 	if !ok {
 		return errExtHeader
@@ -212,8 +333,8 @@ func (mw *metaWire) onExtHandshake(ctx context.Context, payload []byte) error {
 		return errors.New("metadata_size too long")
 	}
 
-	if metadataSize < 0 {
-		return errors.New("negative metadata_size")
+	if metadataSize <= 0 {
+		return errors.New("metadata_size not positive")
 	}
 
 	m, ok := dict["m"].(map[string]interface{})
@@ -233,6 +354,7 @@ func (mw *metaWire) onExtHandshake(ctx context.Context, payload []byte) error {
 		mw.numOfPieces++
 	}
 	mw.pieces = make([][]byte, mw.numOfPieces)
+	mw.requests = make([]int, mw.numOfPieces)
 
 	for i := 0; i < mw.numOfPieces; i++ {
 		mw.requestPiece(ctx, i)
@@ -241,60 +363,113 @@ func (mw *metaWire) onExtHandshake(ctx context.Context, payload []byte) error {
 	return nil
 }
 
+// onPeerInfo records what the extension handshake dict tells about the peer.
+func (mw *metaWire) onPeerInfo(dict map[string]interface{}) {
+	mw.client, _ = dict["v"].(string)
+	if reqq, ok := dict["reqq"].(int64); ok && reqq > 0 {
+		mw.reqq = int(reqq)
+	}
+	if yourIP, ok := dict["yourip"].(string); ok && (len(yourIP) == net.IPv4len || len(yourIP) == net.IPv6len) {
+		mw.yourIP = net.IP(yourIP)
+	}
+}
+
 func (mw *metaWire) requestPiece(ctx context.Context, i int) {
+	mw.requests[i]++
+	mw.sendMetadata(ctx, utRequest, i)
+}
+
+// sendMetadata sends a ut_metadata message without payload, a request or a
+// reject.
+func (mw *metaWire) sendMetadata(ctx context.Context, msgType, i int) {
 	buf := bytes.NewBuffer(nil)
 	buf.WriteByte(byte(extended))
 	buf.WriteByte(byte(mw.utMetadata))
 	buf.Write(bencode.Encode(map[string]interface{}{
-		"msg_type": 0,
+		"msg_type": msgType,
 		"piece":    i,
 	}))
 	mw.write(ctx, buf.Bytes())
 }
 
 func (mw *metaWire) onExtended(ctx context.Context, ext byte, payload []byte) error {
-	if ext == 0 {
-		if err := mw.onExtHandshake(ctx, payload); err != nil {
-			return err
-		}
-	} else {
-		piece, index, err := mw.onPiece(ctx, payload)
-		if err != nil {
-			return err
-		}
-		mw.pieces[index] = piece
-	}
-	return nil
+	switch ext {
+	case extHandshake:
+		return mw.onExtHandshake(ctx, payload)
+	case utPexID:
+		mw.onPexMessage(payload)
+		return nil
+	}
+	return mw.onPiece(ctx, payload)
 }
 
-func (mw *metaWire) onPiece(ctx context.Context, payload []byte) ([]byte, int, error) {
+func (mw *metaWire) onPiece(ctx context.Context, payload []byte) error {
 	select {
 	case <-ctx.Done():
-		return nil, -1, errTimeout
+		return errTimeout
 	default:
 	}
 
-	trailerIndex := bytes.Index(payload, []byte("ee")) + 2
-	if trailerIndex == 1 {
-		return nil, 0, errInvalidPiece
+	// the piece follows the dictionary, which may well contain "ee" itself
+	v, n, err := decodeBencode(payload)
+	if err != nil {
+		return errInvalidPiece
 	}
 
-	dict, err := bencode.Decode(bytes.NewBuffer(payload[:trailerIndex]))
-	if err != nil {
-		return nil, 0, errInvalidPiece
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return errInvalidPiece
 	}
 
 	pieceIndex, ok := dict["piece"].(int64)
-	if !ok || int(pieceIndex) >= mw.numOfPieces {
-		return nil, 0, errInvalidPiece
+	if !ok || pieceIndex < 0 || pieceIndex >= int64(mw.numOfPieces) {
+		return errInvalidPiece
+	}
+	i := int(pieceIndex)
+
+	msgType, _ := dict["msg_type"].(int64)
+	switch msgType {
+	case utData:
+		if totalSize, ok := dict["total_size"].(int64); ok && totalSize != int64(mw.metadataSize) {
+			return fmt.Errorf("total_size %d differs from metadata_size %d", totalSize, mw.metadataSize)
+		}
+
+		piece := payload[n:]
+		if size := mw.pieceSize(i); len(piece) != size {
+			return mw.rerequest(ctx, i, fmt.Errorf("%d bytes instead of %d", len(piece), size))
+		}
+		mw.pieces[i] = piece
+	case utReject:
+		return mw.rerequest(ctx, i, errPieceRejected)
+	case utRequest:
+		// we have no metadata to give, but should not leave the peer waiting
+		mw.sendMetadata(ctx, utReject, i)
 	}
 
-	msgType, ok := dict["msg_type"].(int64)
-	if !ok || msgType != 1 {
-		return nil, 0, errInvalidPiece
+	// other message types are to be ignored (BEP 9)
+	return nil
+}
+
+// pieceSize returns the size of piece i, the last one taking the remainder.
+func (mw *metaWire) pieceSize(i int) int {
+	if i == mw.numOfPieces-1 {
+		return mw.metadataSize - perBlock*i
 	}
+	return perBlock
+}
 
-	return payload[trailerIndex:], int(pieceIndex), nil
+// rerequest asks for piece i again after a reject or a bad piece, unless it
+// was requested too often already.
+func (mw *metaWire) rerequest(ctx context.Context, i int, reason error) error {
+	if mw.pieces[i] != nil {
+		return nil
+	}
+	if mw.requests[i] >= maxPieceRequests {
+		return fmt.Errorf("piece %d: %v, after %d requests", i, reason, mw.requests[i])
+	}
+
+	mw.requestPiece(ctx, i)
+	return nil
 }
 
 func (mw *metaWire) checkDone() bool {
@@ -321,6 +496,9 @@ func (mw *metaWire) next(ctx context.Context) ([]byte, error) {
 	}
 
 	size := binary.BigEndian.Uint32(data)
+	if size > maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes too long", size)
+	}
 	data, err = mw.read(ctx, size)
 	if err != nil {
 		return nil, err
@@ -336,13 +514,16 @@ func (mw *metaWire) read(ctx context.Context, size uint32) ([]byte, error) {
 	default:
 	}
 
-	buf := bytes.NewBuffer(nil)
-	_, err := io.CopyN(buf, mw.conn, int64(size))
-	if err != nil {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(mw.conn, buf); err != nil {
+		if ctx.Err() != nil {
+			// the connection was closed or timed out under us
+			return nil, errTimeout
+		}
 		return nil, fmt.Errorf("read %d bytes message failed: %v", size, err)
 	}
 
-	return buf.Bytes(), nil
+	return buf, nil
 }
 
 func (mw *metaWire) write(ctx context.Context, data []byte) error {
@@ -358,12 +539,30 @@ func (mw *metaWire) write(ctx context.Context, data []byte) error {
 	buf.Write(data)
 	_, err := mw.conn.Write(buf.Bytes())
 	if err != nil {
+		if ctx.Err() != nil {
+			return errTimeout
+		}
 		return fmt.Errorf("write message failed: %v", err)
 	}
 
 	return nil
 }
 
+// close closes the connection to the peer, if any. It may be called again.
+func (mw *metaWire) close() {
+	if mw.conn != nil {
+		mw.conn.Close()
+	}
+}
+
+// free closes the connection and returns mw to the pool, without what it
+// references so that the pool does not keep pieces or connections alive.
 func (mw *metaWire) free() {
+	mw.close()
+	mw.conn = nil
+	mw.pieces = nil
+	mw.requests = nil
+	mw.onPex = nil
+	mw.yourIP = nil
 	metaWirePool.Put(mw)
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stallingPeer accepts connections and misbehaves on them with serve until
+// the fetcher hangs up.
+func stallingPeer(t *testing.T, serve func(c net.Conn)) net.Listener {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				serve(c)
+			}()
+		}
+	}()
+
+	return ln
+}
+
+func openFDs(t *testing.T) int {
+	t.Helper()
+
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("no /proc/self/fd")
+	}
+	return len(fds)
+}
+
+// TestFetchCtxReleasesStalledPeers runs hundreds of fetches against peers
+// which stall and checks that each gives back its goroutines and file
+// descriptors once its context is done, whether cancelled or past the
+// deadline.
+func TestFetchCtxReleasesStalledPeers(t *testing.T) {
+	const (
+		fetches = 300
+		timeout = 500 * time.Millisecond
+		slack   = 2 * time.Second
+	)
+
+	peers := []net.Listener{
+		// stalls after accept, reading until we hang up
+		stallingPeer(t, func(c net.Conn) {
+			io.Copy(io.Discard, c)
+		}),
+		// stalls after the handshake
+		stallingPeer(t, func(c net.Conn) {
+			hs := make([]byte, 68)
+			if _, err := io.ReadFull(c, hs); err != nil {
+				return
+			}
+			hs[25] |= 0x10
+			c.Write(hs)
+			io.Copy(io.Discard, c)
+		}),
+		// drips the handshake a byte at a time
+		stallingPeer(t, func(c net.Conn) {
+			hs := make([]byte, 68)
+			if _, err := io.ReadFull(c, hs); err != nil {
+				return
+			}
+			for _, b := range hs {
+				if _, err := c.Write([]byte{b}); err != nil {
+					return
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			io.Copy(io.Discard, c)
+		}),
+	}
+	defer func() {
+		for _, ln := range peers {
+			ln.Close()
+		}
+	}()
+
+	// let the listeners settle before taking the baseline
+	time.Sleep(50 * time.Millisecond)
+	goroutines, fds := runtime.NumGoroutine(), openFDs(t)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < fetches; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			var ctx context.Context
+			var cancel context.CancelFunc
+			if i%3 == 0 {
+				// cancelled, without a deadline to fall back on
+				ctx, cancel = context.WithCancel(context.Background())
+				time.AfterFunc(timeout/2, cancel)
+			} else {
+				ctx, cancel = context.WithTimeout(context.Background(), timeout)
+			}
+			defer cancel()
+
+			wire := newMetaWire(string(make([]byte, 20)), peers[i%len(peers)].Addr().String(), timeout)
+			defer wire.free()
+
+			if _, err := wire.fetchCtx(ctx); err == nil {
+				t.Errorf("fetch %d from a stalling peer succeeded", i)
+			}
+		}(i)
+	}
+	returned := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(timeout + slack):
+		buf := make([]byte, 1<<20)
+		t.Fatalf("fetches still running after %v\n%s", time.Since(start), buf[:runtime.Stack(buf, true)])
+	}
+
+	// the peers notice we hung up and close their side too
+	var g, f int
+	for deadline := time.Now().Add(timeout + slack); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		g, f = runtime.NumGoroutine(), openFDs(t)
+		if g <= goroutines && f <= fds {
+			return
+		}
+	}
+
+	buf := make([]byte, 1<<20)
+	t.Fatalf("%d goroutines and %d fds left, baseline %d and %d\n%s", g, f, goroutines, fds, buf[:runtime.Stack(buf, true)])
+}
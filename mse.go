@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+)
+
+// modes of the --encryption flag
+const (
+	encryptionPrefer  = "prefer"  // try MSE first, plaintext if the peer does not speak it
+	encryptionRequire = "require" // RC4 or nothing
+	encryptionDisable = "disable" // plaintext only
+)
+
+// crypto methods of MSE
+const (
+	msePlaintext = 0x01
+	mseRC4       = 0x02
+)
+
+const (
+	mseKeySize = 96
+	// mseMaxPad is the most padding either side may send.
+	mseMaxPad = 512
+)
+
+// mseP is the 768 bit prime of Message Stream Encryption, the generator is 2.
+var mseP, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+
+var errMSESync = errors.New("mse: peer did not answer the key exchange")
+
+func validEncryption(mode string) bool {
+	switch mode {
+	case encryptionPrefer, encryptionRequire, encryptionDisable:
+		return true
+	}
+	return false
+}
+
+// mseConn is a connection after the MSE handshake, RC4 encrypted or
+// plaintext as the peer selected.
+type mseConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *mseConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *mseConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func mseHash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// mseCipher returns the RC4 stream of one direction, with the first 1024
+// bytes discarded as the spec requires.
+func mseCipher(name string, s []byte, skey string) *rc4.Cipher {
+	c, _ := rc4.NewCipher(mseHash([]byte(name), s, []byte(skey)))
+	var discard [1024]byte
+	c.XORKeyStream(discard[:], discard[:])
+	return c
+}
+
+// mseHandshake runs the initiator side of Message Stream Encryption over
+// conn for infohash, offering RC4 and, if allowed, plaintext. It returns the
+// connection to run the BitTorrent handshake over and whether the peer
+// selected RC4.
+func mseHandshake(conn net.Conn, infohash string, allowPlaintext bool) (net.Conn, bool, error) {
+	// private key of 160 bits
+	xa := new(big.Int).SetBytes(randBytes(20))
+	ya := new(big.Int).Exp(big.NewInt(2), xa, mseP)
+
+	padA := randBytes(int(randBytes(1)[0]) % (mseMaxPad / 4))
+	if _, err := conn.Write(append(ya.FillBytes(make([]byte, mseKeySize)), padA...)); err != nil {
+		return nil, false, fmt.Errorf("mse: %v", err)
+	}
+
+	r := bufio.NewReaderSize(conn, 1024)
+	yb := make([]byte, mseKeySize)
+	if _, err := io.ReadFull(r, yb); err != nil {
+		// peers which do not speak MSE hang up on what looks like a bad
+		// handshake
+		return nil, false, errMSESync
+	}
+
+	s := new(big.Int).Exp(new(big.Int).SetBytes(yb), xa, mseP).FillBytes(make([]byte, mseKeySize))
+	encA := mseCipher("keyA", s, infohash)
+	decB := mseCipher("keyB", s, infohash)
+
+	provide := uint32(mseRC4)
+	if allowPlaintext {
+		provide |= msePlaintext
+	}
+
+	// VC, crypto_provide, len(PadC) and len(IA), all zero but the provide
+	var plain [8 + 4 + 2 + 2]byte
+	binary.BigEndian.PutUint32(plain[8:12], provide)
+	encrypted := make([]byte, len(plain))
+	encA.XORKeyStream(encrypted, plain[:])
+
+	req2 := mseHash([]byte("req2"), []byte(infohash))
+	req3 := mseHash([]byte("req3"), s)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write(mseHash([]byte("req1"), s))
+	buf.Write(req2)
+	buf.Write(encrypted)
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, false, fmt.Errorf("mse: %v", err)
+	}
+
+	// the peer pads before its encrypted VC, find where it starts
+	vc := make([]byte, 8)
+	mseCipher("keyB", s, infohash).XORKeyStream(vc, vc)
+	window := make([]byte, 0, len(vc))
+	for skipped := 0; ; {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, false, errMSESync
+		}
+		if len(window) == len(vc) {
+			window = window[1:]
+			skipped++
+		}
+		window = append(window, c)
+		if bytes.Equal(window, vc) {
+			break
+		}
+		if skipped > mseMaxPad {
+			return nil, false, errors.New("mse: verification constant not found")
+		}
+	}
+	decB.XORKeyStream(window, window)
+
+	// crypto_select and len(PadD), then PadD
+	var selected [4 + 2]byte
+	if _, err := io.ReadFull(r, selected[:]); err != nil {
+		return nil, false, errMSESync
+	}
+	decB.XORKeyStream(selected[:], selected[:])
+
+	method := binary.BigEndian.Uint32(selected[:4])
+	padD := int(binary.BigEndian.Uint16(selected[4:6]))
+	if padD > mseMaxPad {
+		return nil, false, fmt.Errorf("mse: padding of %d bytes", padD)
+	}
+	pad := make([]byte, padD)
+	if _, err := io.ReadFull(r, pad); err != nil {
+		return nil, false, errMSESync
+	}
+	decB.XORKeyStream(pad, pad)
+
+	switch {
+	case method == mseRC4:
+		return &mseConn{
+			Conn: conn,
+			r:    cipher.StreamReader{S: decB, R: r},
+			w:    cipher.StreamWriter{S: encA, W: conn},
+		}, true, nil
+	case method == msePlaintext && allowPlaintext:
+		// what the reader buffered is plaintext already
+		return &mseConn{Conn: conn, r: r, w: conn}, false, nil
+	}
+	return nil, false, fmt.Errorf("mse: peer selected crypto method %#x", method)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// link types of the pcap format we can decode
+const (
+	linkNull      = 0
+	linkEthernet  = 1
+	linkRaw       = 101
+	linkRawAlt    = 12 // raw IP on OpenBSD
+	linkLinuxSLL  = 113
+	linkLinuxSLL2 = 276
+)
+
+const (
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+
+	tcpSyn = 0x02
+	tcpAck = 0x10
+)
+
+var errPcapng = errors.New("pcapng captures are not supported, convert with: editcap -F pcap in.pcapng out.pcap")
+
+// pcapPacket is a UDP datagram or a TCP segment read from a capture.
+type pcapPacket struct {
+	at      time.Time
+	proto   int // ipProtoTCP or ipProtoUDP
+	src     net.IP
+	dst     net.IP
+	srcPort int
+	dstPort int
+	seq     uint32 // TCP only
+	flags   byte   // TCP only
+	payload []byte
+}
+
+func (p *pcapPacket) srcAddr() string {
+	return net.JoinHostPort(p.src.String(), fmt.Sprint(p.srcPort))
+}
+
+func (p *pcapPacket) dstAddr() string {
+	return net.JoinHostPort(p.dst.String(), fmt.Sprint(p.dstPort))
+}
+
+// pcapReader reads the UDP and TCP packets of a capture in the classic pcap
+// format, skipping anything else.
+type pcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nanos    bool
+	linkType uint32
+	header   [16]byte
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	var header [24]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("read pcap header failed: %v", err)
+	}
+
+	pr := &pcapReader{r: r}
+	switch magic := binary.LittleEndian.Uint32(header[:4]); magic {
+	case 0xa1b2c3d4:
+		pr.order = binary.LittleEndian
+	case 0xa1b23c4d:
+		pr.order, pr.nanos = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		pr.order = binary.BigEndian
+	case 0x4d3cb2a1:
+		pr.order, pr.nanos = binary.BigEndian, true
+	case 0x0a0d0d0a:
+		return nil, errPcapng
+	default:
+		return nil, fmt.Errorf("not a pcap file: magic %#x", magic)
+	}
+
+	pr.linkType = pr.order.Uint32(header[20:24]) & 0xffff
+	switch pr.linkType {
+	case linkNull, linkEthernet, linkRaw, linkRawAlt, linkLinuxSLL, linkLinuxSLL2:
+	default:
+		return nil, fmt.Errorf("unsupported pcap link type %d", pr.linkType)
+	}
+
+	return pr, nil
+}
+
+// next returns the next UDP or TCP packet, or io.EOF at the end of the
+// capture.
+func (pr *pcapReader) next() (*pcapPacket, error) {
+	for {
+		if _, err := io.ReadFull(pr.r, pr.header[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, fmt.Errorf("truncated pcap record header")
+			}
+			return nil, err
+		}
+
+		size := pr.order.Uint32(pr.header[8:12])
+		if size > 1<<18 {
+			return nil, fmt.Errorf("pcap record too large: %d bytes", size)
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(pr.r, data); err != nil {
+			return nil, fmt.Errorf("truncated pcap record: %v", err)
+		}
+
+		sec := int64(pr.order.Uint32(pr.header[0:4]))
+		frac := int64(pr.order.Uint32(pr.header[4:8]))
+		if !pr.nanos {
+			frac *= int64(time.Microsecond)
+		}
+
+		if p := pr.decode(data); p != nil {
+			p.at = time.Unix(sec, frac)
+			return p, nil
+		}
+	}
+}
+
+// decode strips the link layer of a frame and decodes its IP packet.
+func (pr *pcapReader) decode(data []byte) *pcapPacket {
+	var etherType uint16
+	switch pr.linkType {
+	case linkNull:
+		// address family in the byte order of the capturing host
+		if len(data) < 4 {
+			return nil
+		}
+		family := binary.LittleEndian.Uint32(data[:4])
+		if family > 0xffff {
+			family = binary.BigEndian.Uint32(data[:4])
+		}
+		data = data[4:]
+		switch family {
+		case 2:
+			etherType = 0x0800
+		case 24, 28, 30:
+			etherType = 0x86dd
+		}
+	case linkEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+		etherType, data = binary.BigEndian.Uint16(data[12:14]), data[14:]
+		// 802.1Q and 802.1ad tags
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(data) >= 4 {
+			etherType, data = binary.BigEndian.Uint16(data[2:4]), data[4:]
+		}
+	case linkRaw, linkRawAlt:
+		if len(data) > 0 {
+			switch data[0] >> 4 {
+			case 4:
+				etherType = 0x0800
+			case 6:
+				etherType = 0x86dd
+			}
+		}
+	case linkLinuxSLL:
+		if len(data) < 16 {
+			return nil
+		}
+		etherType, data = binary.BigEndian.Uint16(data[14:16]), data[16:]
+	case linkLinuxSLL2:
+		if len(data) < 20 {
+			return nil
+		}
+		etherType, data = binary.BigEndian.Uint16(data[0:2]), data[20:]
+	}
+
+	switch etherType {
+	case 0x0800:
+		return decodeIPv4(data)
+	case 0x86dd:
+		return decodeIPv6(data)
+	}
+	return nil
+}
+
+func decodeIPv4(data []byte) *pcapPacket {
+	if len(data) < 20 || data[0]>>4 != 4 {
+		return nil
+	}
+
+	headerLen := int(data[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(data[2:4]))
+	if headerLen < 20 || total < headerLen || total > len(data) {
+		return nil
+	}
+
+	// fragments are rare in DHT and peer traffic, so we do not reassemble them
+	if binary.BigEndian.Uint16(data[6:8])&0x3fff != 0 {
+		return nil
+	}
+
+	p := &pcapPacket{
+		src: net.IP(append([]byte(nil), data[12:16]...)),
+		dst: net.IP(append([]byte(nil), data[16:20]...)),
+	}
+	return decodeTransport(p, int(data[9]), data[headerLen:total])
+}
+
+func decodeIPv6(data []byte) *pcapPacket {
+	if len(data) < 40 || data[0]>>4 != 6 {
+		return nil
+	}
+
+	total := 40 + int(binary.BigEndian.Uint16(data[4:6]))
+	if total > len(data) {
+		return nil
+	}
+
+	p := &pcapPacket{
+		src: net.IP(append([]byte(nil), data[8:24]...)),
+		dst: net.IP(append([]byte(nil), data[24:40]...)),
+	}
+
+	next, data := int(data[6]), data[40:total]
+	for {
+		switch next {
+		case 0, 43, 60: // hop-by-hop, routing and destination options
+			if len(data) < 8 {
+				return nil
+			}
+			size := (int(data[1]) + 1) * 8
+			if size > len(data) {
+				return nil
+			}
+			next, data = int(data[0]), data[size:]
+			continue
+		case 44: // fragment
+			return nil
+		}
+		return decodeTransport(p, next, data)
+	}
+}
+
+func decodeTransport(p *pcapPacket, proto int, data []byte) *pcapPacket {
+	switch proto {
+	case ipProtoUDP:
+		if len(data) < 8 {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[4:6]))
+		if length < 8 || length > len(data) {
+			// truncated by the snap length
+			return nil
+		}
+		p.payload = data[8:length]
+	case ipProtoTCP:
+		if len(data) < 20 {
+			return nil
+		}
+		headerLen := int(data[12]>>4) * 4
+		if headerLen < 20 || headerLen > len(data) {
+			return nil
+		}
+		p.seq = binary.BigEndian.Uint32(data[4:8])
+		p.flags = data[13]
+		p.payload = data[headerLen:]
+	default:
+		return nil
+	}
+
+	p.proto = proto
+	p.srcPort = int(binary.BigEndian.Uint16(data[0:2]))
+	p.dstPort = int(binary.BigEndian.Uint16(data[2:4]))
+	return p
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+)
+
+const (
+	// our extension message IDs, advertised in the extension handshake
+	utMetadataID = 1
+	utPexID      = 2
+
+	// pexSeed is the flag of a peer which only uploads (BEP 11).
+	pexSeed = 0x02
+	// maxFetchCandidates bounds the peers tried for an infohash, PEX being
+	// able to hand out many.
+	maxFetchCandidates = 64
+)
+
+// pexPeer is a peer learnt from a ut_pex message.
+type pexPeer struct {
+	addr *net.TCPAddr
+	seed bool
+}
+
+// decodePex returns the peers added by a ut_pex message (BEP 11).
+func decodePex(payload []byte) ([]pexPeer, error) {
+	v, _, err := decodeBencode(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("ut_pex message not a dictionary")
+	}
+
+	var peers []pexPeer
+	for _, family := range []struct {
+		key   string
+		ipLen int
+	}{{"added", net.IPv4len}, {"added6", net.IPv6len}} {
+		compact, _ := dict[family.key].(string)
+		flags, _ := dict[family.key+".f"].(string)
+
+		size := family.ipLen + 2
+		for i := 0; i+size <= len(compact); i += size {
+			ip := net.IP([]byte(compact[i : i+family.ipLen]))
+			port := int(binary.BigEndian.Uint16([]byte(compact[i+family.ipLen : i+size])))
+			if port == 0 || ip.IsUnspecified() {
+				continue
+			}
+
+			p := pexPeer{addr: &net.TCPAddr{IP: ip, Port: port}}
+			if n := i / size; n < len(flags) {
+				p.seed = flags[n]&pexSeed != 0
+			}
+			peers = append(peers, p)
+		}
+	}
+
+	return peers, nil
+}
+
+func (mw *metaWire) onPexMessage(payload []byte) {
+	peers, err := decodePex(payload)
+	if err != nil {
+		log.Printf("invalid ut_pex message from %s: %v", mw.from, err)
+		return
+	}
+	if len(peers) > 0 && mw.onPex != nil {
+		mw.onPex(peers)
+	}
+}
+
+// pexSwarm estimates a swarm from the peers PEX told us about, if it was
+// never scraped: seeders and leechers are at least that many. The estimate is
+// stored without a scrape time, so that the torrent is still scraped soon.
+func pexSwarm(infohashHex string, peers map[string]bool) {
+	if data, err := index.GetInternal(swarmKey(infohashHex)); err != nil || len(data) > 0 {
+		return
+	}
+
+	var s swarm
+	for _, seed := range peers {
+		if seed {
+			s.Seeders++
+		} else {
+			s.Leechers++
+		}
+	}
+
+	if err := storeSwarm(infohashHex, s); err != nil {
+		log.Printf("error storing PEX swarm of %s: %v", infohashHex, err)
+	}
+}
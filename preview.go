@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/marksamman/bencode"
+)
+
+const (
+	// maxPreviewFiles is the number of files previewed per torrent.
+	maxPreviewFiles = 4
+	// maxPreviewDownload bounds the bytes of pieces downloaded per torrent,
+	// as a small file may well lie in a big piece.
+	maxPreviewDownload = 8 << 20
+	// maxPreviews is the number of previews downloading at once, apart from
+	// the fetches of metadata.
+	maxPreviews = 16
+	// previewRequests is the number of block requests outstanding to a peer
+	// which does not tell its reqq, maxPreviewRequests to one which does.
+	previewRequests    = 16
+	maxPreviewRequests = 250
+)
+
+// BitTorrent messages of the piece download
+const (
+	msgChoke      = 0
+	msgUnchoke    = 1
+	msgInterested = 2
+	msgBitfield   = 5
+	msgRequest    = 6
+	msgPiece      = 7
+)
+
+// previewExts are the extensions of the files worth a preview.
+var previewExts = map[string]bool{
+	".nfo":  true,
+	".diz":  true,
+	".txt":  true,
+	".md":   true,
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+}
+
+var errPieceMissing = errors.New("peer does not have the piece")
+
+// previewFile is a file to preview and where it lies in the torrent.
+type previewFile struct {
+	name   string
+	offset int64
+	length int64
+}
+
+// pieces returns the indexes of the pieces file lies in.
+func (f previewFile) pieces(pieceLength int64) (first, last int) {
+	return int(f.offset / pieceLength), int((f.offset + f.length - 1) / pieceLength)
+}
+
+func previewKey(infohashHex, name string) []byte {
+	return []byte("preview:" + infohashHex + ":" + name)
+}
+
+func previewsKey(infohashHex string) []byte {
+	return []byte("previews:" + infohashHex)
+}
+
+// previewFiles returns the text and image files of the info dictionary dict
+// of at most maxSize bytes, with the piece length and the total length. Only
+// v1 pieces are SHA-1 hashes we can verify, so v2 torrents have none.
+func previewFiles(dict map[string]interface{}, maxSize int64) ([]previewFile, int64, int64) {
+	pieceLength, _ := dict["piece length"].(int64)
+	pieces, _ := dict["pieces"].(string)
+	if pieceLength <= 0 || pieceLength > maxPreviewDownload || len(pieces)%sha1.Size != 0 {
+		return nil, 0, 0
+	}
+
+	var all []previewFile
+	var offset int64
+	if length, ok := dict["length"].(int64); ok {
+		name, _ := dict["name.utf-8"].(string)
+		if name == "" {
+			name, _ = dict["name"].(string)
+		}
+		all = append(all, previewFile{name: name, length: length})
+		offset = length
+	} else if files, ok := dict["files"].([]interface{}); ok {
+		for _, file := range files {
+			f, ok := file.(map[string]interface{})
+			if !ok {
+				return nil, 0, 0
+			}
+			length, _ := f["length"].(int64)
+			if length < 0 {
+				return nil, 0, 0
+			}
+
+			// named as parseTorrent names them
+			parts, ok := f["path.utf-8"].([]interface{})
+			if !ok {
+				parts, _ = f["path"].([]interface{})
+			}
+			name := make([]string, len(parts))
+			for i, v := range parts {
+				name[i] = fmt.Sprint(v)
+			}
+
+			// padding files (BEP 47) take their place in the pieces too
+			if attr, _ := f["attr"].(string); !strings.Contains(attr, "p") {
+				all = append(all, previewFile{name: strings.Join(name, "/"), offset: offset, length: length})
+			}
+			offset += length
+		}
+	}
+
+	if int64(len(pieces)/sha1.Size) != (offset+pieceLength-1)/pieceLength {
+		return nil, 0, 0
+	}
+
+	var files []previewFile
+	for _, f := range all {
+		if f.length > 0 && f.length <= maxSize && previewExts[strings.ToLower(path.Ext(f.name))] {
+			files = append(files, f)
+		}
+	}
+
+	// the info files first, then the smallest
+	sort.SliceStable(files, func(i, j int) bool {
+		ni := isText(files[i].name)
+		if nj := isText(files[j].name); ni != nj {
+			return ni
+		}
+		return files[i].length < files[j].length
+	})
+
+	return files, pieceLength, offset
+}
+
+func isText(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".nfo", ".diz", ".txt", ".md":
+		return true
+	}
+	return false
+}
+
+// preview downloads the small text and image files of the torrent of
+// infohash from peer and stores them, for GET /torrent/preview.
+func (t *torsniff) preview(infohash string, torrent *torrent, meta []byte, peer string) {
+	dict, err := bencode.Decode(bytes.NewBuffer(meta))
+	if err != nil {
+		return
+	}
+
+	candidates, pieceLength, total := previewFiles(dict, t.previewSize)
+	hashes, _ := dict["pieces"].(string)
+
+	// the pieces of as many files as the download allows
+	var files []previewFile
+	needed := make(map[int]bool)
+	var size int64
+	for _, f := range candidates {
+		if len(files) == maxPreviewFiles {
+			break
+		}
+
+		first, last := f.pieces(pieceLength)
+		var more int64
+		for i := first; i <= last; i++ {
+			if !needed[i] {
+				more += pieceLength
+			}
+		}
+		if size+more > maxPreviewDownload {
+			continue
+		}
+
+		size += more
+		for i := first; i <= last; i++ {
+			needed[i] = true
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+
+	wire := newMetaWire(infohash, peer, t.timeout)
+	wire.utp = t.utp
+	wire.encryption = t.encryption
+	defer wire.free()
+
+	pieces, err := wire.fetchPieces(ctx, needed, pieceLength, total, hashes)
+	if err != nil {
+		log.Printf("no preview of %s from %s: %v", torrent.InfohashHex, peer, err)
+		return
+	}
+
+	var names []string
+	for _, f := range files {
+		data := make([]byte, 0, f.length)
+		first, last := f.pieces(pieceLength)
+		for i := first; i <= last; i++ {
+			piece := pieces[i]
+			start, end := int64(0), int64(len(piece))
+			if i == first {
+				start = f.offset - int64(i)*pieceLength
+			}
+			if i == last {
+				end = f.offset + f.length - int64(i)*pieceLength
+			}
+			data = append(data, piece[start:end]...)
+		}
+
+		if err := index.SetInternal(previewKey(torrent.InfohashHex, f.name), data); err != nil {
+			log.Printf("error storing preview of %s: %v", torrent.InfohashHex, err)
+			return
+		}
+		names = append(names, f.name)
+	}
+
+	data, _ := json.Marshal(names)
+	if err := index.SetInternal(previewsKey(torrent.InfohashHex), data); err != nil {
+		log.Printf("error storing previews of %s: %v", torrent.InfohashHex, err)
+		return
+	}
+	log.Printf("stored %d previews of %s", len(names), torrent.InfohashHex)
+}
+
+// loadPreviews fills in the files of t with a preview, if any.
+func (t *torrent) loadPreviews() {
+	data, err := index.GetInternal(previewsKey(t.InfohashHex))
+	if err != nil || len(data) == 0 {
+		return
+	}
+	json.Unmarshal(data, &t.Previews)
+}
+
+// deletePreviews deletes the previews of infohashHex, if any.
+func deletePreviews(infohashHex string) {
+	t := &torrent{InfohashHex: infohashHex}
+	t.loadPreviews()
+	for _, name := range t.Previews {
+		index.DeleteInternal(previewKey(infohashHex, name))
+	}
+	index.DeleteInternal(previewsKey(infohashHex))
+}
+
+// previewBlock is a block of a piece to download.
+type previewBlock struct {
+	piece int
+	begin int64
+}
+
+// fetchPieces downloads the needed pieces from the peer over a connection of
+// its own and verifies them against their SHA-1 hashes. The block requests
+// are pipelined up to the reqq of the peer.
+func (mw *metaWire) fetchPieces(ctx context.Context, needed map[int]bool, pieceLength, total int64, hashes string) (map[int][]byte, error) {
+	mw.connect(ctx)
+	if mw.err != nil {
+		return nil, mw.err
+	}
+	defer mw.close()
+
+	mw.handshake(ctx)
+	mw.onHandshake(ctx)
+	mw.extHandshake(ctx)
+	if mw.err != nil {
+		return nil, mw.err
+	}
+	if err := mw.write(ctx, []byte{msgInterested}); err != nil {
+		return nil, err
+	}
+
+	size := func(i int) int64 {
+		if end := int64(i+1) * pieceLength; end > total {
+			return total - int64(i)*pieceLength
+		}
+		return pieceLength
+	}
+
+	pieces := make(map[int][]byte)
+	received := make(map[int]map[int64]bool) // blocks received by piece
+	var blocks []previewBlock                // in the order they are requested
+	for i := range needed {
+		pieces[i] = make([]byte, size(i))
+		received[i] = make(map[int64]bool)
+		for begin := int64(0); begin < size(i); begin += perBlock {
+			blocks = append(blocks, previewBlock{i, begin})
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		a, b := blocks[i], blocks[j]
+		return a.piece < b.piece || a.piece == b.piece && a.begin < b.begin
+	})
+
+	choked := true
+	depth := previewRequests
+	requested := make(map[previewBlock]bool)
+
+	// request what is missing, up to depth at once, again after a choke,
+	// which drops the requests
+	request := func() error {
+		for _, b := range blocks {
+			if choked || len(requested) >= depth {
+				return nil
+			}
+			if got, ok := received[b.piece]; !ok || got[b.begin] || requested[b] {
+				continue
+			}
+
+			length := size(b.piece) - b.begin
+			if length > perBlock {
+				length = perBlock
+			}
+
+			msg := make([]byte, 13)
+			msg[0] = msgRequest
+			binary.BigEndian.PutUint32(msg[1:], uint32(b.piece))
+			binary.BigEndian.PutUint32(msg[5:], uint32(b.begin))
+			binary.BigEndian.PutUint32(msg[9:], uint32(length))
+			if err := mw.write(ctx, msg); err != nil {
+				return err
+			}
+			requested[b] = true
+		}
+		return nil
+	}
+
+	done := make(map[int][]byte)
+	for len(done) < len(needed) {
+		data, err := mw.next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		switch data[0] {
+		case msgUnchoke:
+			choked = false
+			if err := request(); err != nil {
+				return nil, err
+			}
+		case extended:
+			if len(data) < 2 || data[1] != extHandshake {
+				continue
+			}
+			dict, err := bencode.Decode(bytes.NewBuffer(data[2:]))
+			if err != nil {
+				return nil, errExtHeader
+			}
+			mw.onPeerInfo(dict)
+			if mw.reqq > 0 {
+				depth = min(mw.reqq, maxPreviewRequests)
+			}
+			if err := request(); err != nil {
+				return nil, err
+			}
+		case msgBitfield:
+			bitfield := data[1:]
+			for i := range needed {
+				if i/8 >= len(bitfield) || bitfield[i/8]&(0x80>>(i%8)) == 0 {
+					return nil, errPieceMissing
+				}
+			}
+		case msgPiece:
+			if len(data) < 9 {
+				return nil, errInvalidPiece
+			}
+			i := int(binary.BigEndian.Uint32(data[1:5]))
+			begin := int64(binary.BigEndian.Uint32(data[5:9]))
+			block := data[9:]
+
+			got, ok := received[i]
+			piece := pieces[i]
+			if !ok || begin%perBlock != 0 || begin+int64(len(block)) > int64(len(piece)) || got[begin] {
+				// not asked for, or a duplicate
+				continue
+			}
+			copy(piece[begin:], block)
+			got[begin] = true
+			delete(requested, previewBlock{i, begin})
+			if err := request(); err != nil {
+				return nil, err
+			}
+
+			if int64(len(got)) < (int64(len(piece))+perBlock-1)/perBlock {
+				continue
+			}
+			sum := sha1.Sum(piece)
+			if !bytes.Equal(sum[:], []byte(hashes[i*sha1.Size:(i+1)*sha1.Size])) {
+				return nil, fmt.Errorf("piece %d hash mismatch", i)
+			}
+			done[i] = piece
+			delete(received, i)
+		case msgChoke:
+			// requests are dropped, they are sent again on the unchoke
+			choked = true
+			clear(requested)
+		}
+
+		// other messages, have, extension handshakes and the like, do not
+		// matter to us
+	}
+
+	return done, nil
+}
+
+// cp437 are the characters of code page 437 from 0x80, the encoding of
+// most NFO files.
+var cp437 = []rune("ÇüéâäàåçêëèïîìÄÅÉæÆôöòûùÿÖÜ¢£¥₧ƒáíóúñÑªº¿⌐¬½¼¡«»░▒▓│┤╡╢╖╕╣║╗╝╜╛┐└┴┬├─┼╞╟╚╔╩╦╠═╬╧╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀αßΓπΣσµτΦΘΩδ∞φε∩≡±≥≤⌠⌡÷≈°∙·√ⁿ²■\u00a0")
+
+// decodeCP437 returns the UTF-8 of an NFO file, unless it is UTF-8 already.
+func decodeCP437(data []byte) []byte {
+	if utf8.Valid(data) {
+		return data
+	}
+
+	var buf bytes.Buffer
+	for _, c := range data {
+		if c < 0x80 {
+			buf.WriteByte(c)
+		} else {
+			buf.WriteRune(cp437[c-0x80])
+		}
+	}
+	return buf.Bytes()
+}
+
+// previewHandler serves the preview of the file of torrent h.
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	hash := r.URL.Query().Get("h")
+	file := r.URL.Query().Get("file")
+	if hash == "" || file == "" {
+		http.Error(w, "Missing hash or file parameter", http.StatusBadRequest)
+		return
+	}
+
+	data, err := index.GetInternal(previewKey(hash, file))
+	if err != nil || len(data) == 0 {
+		http.Error(w, "Preview not found", http.StatusNotFound)
+		return
+	}
+
+	ext := strings.ToLower(path.Ext(file))
+	contentType := mime.TypeByExtension(ext)
+	switch {
+	case ext == ".nfo" || ext == ".diz":
+		data = decodeCP437(data)
+		contentType = "text/plain; charset=utf-8"
+	case isText(file):
+		contentType = "text/plain; charset=utf-8"
+	case !previewExts[ext] || contentType == "":
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(data)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// tcpSegment is the payload of a TCP packet at its sequence number.
+type tcpSegment struct {
+	seq  uint32
+	data []byte
+}
+
+// tcpStream is one direction of a recorded TCP connection.
+type tcpStream struct {
+	src, dst string
+	opener   bool   // sent a SYN without ACK, opening the connection
+	hasISN   bool   // its SYN or SYN-ACK was captured
+	isn      uint32 // initial sequence number, if hasISN
+	segments []tcpSegment
+}
+
+// bytes reassembles the stream up to the first gap in the capture.
+func (s *tcpStream) bytes() []byte {
+	if len(s.segments) == 0 {
+		return nil
+	}
+
+	base := s.segments[0].seq
+	if s.hasISN {
+		base = s.isn + 1
+	}
+
+	// offsets relative to base survive the sequence numbers wrapping around
+	sort.SliceStable(s.segments, func(i, j int) bool {
+		return s.segments[i].seq-base < s.segments[j].seq-base
+	})
+
+	var buf []byte
+	for _, seg := range s.segments {
+		off := int(seg.seq - base)
+		if off > len(buf) {
+			break
+		}
+		if end := off + len(seg.data); end > len(buf) {
+			buf = append(buf, seg.data[len(buf)-off:]...)
+		}
+	}
+	return buf
+}
+
+// replayConn plays back what a peer sent over a recorded connection, and
+// discards what is written to it.
+type replayConn struct {
+	*bytes.Reader
+	local, remote net.Addr
+}
+
+func (c *replayConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c *replayConn) Close() error                       { return nil }
+func (c *replayConn) LocalAddr() net.Addr                { return c.local }
+func (c *replayConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// replay feeds a packet capture through the DHT message handlers and the
+// metadata exchange, as fast as it can.
+type replay struct {
+	dht     *dht
+	port    int
+	index   bool
+	streams map[string]*tcpStream
+	order   []string // stream keys, in the order they were first seen
+
+	packets     int
+	dhtPackets  int
+	announced   map[string]struct{}
+	connections int
+	exchanges   int
+	fetched     int
+	parsed      int
+	failures    map[string]int
+}
+
+func newReplay(port int, indexTorrents bool) (*replay, error) {
+	network := newSimNetwork(0, 0, 0)
+	conn, err := network.listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881})
+	if err != nil {
+		return nil, err
+	}
+	conn6, err := network.listen(&net.UDPAddr{IP: net.IPv6loopback, Port: 6881})
+	if err != nil {
+		return nil, err
+	}
+
+	// the replies to the recorded queries go nowhere
+	d, err := newDHT(dhtConfig{
+		laddr:            conn.LocalAddr().String(),
+		maxFriendsPerSec: 500,
+		conn:             conn,
+		conn6:            conn6,
+		replay:           true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &replay{
+		dht:       d,
+		port:      port,
+		index:     indexTorrents,
+		streams:   make(map[string]*tcpStream),
+		announced: make(map[string]struct{}),
+		failures:  make(map[string]int),
+	}, nil
+}
+
+// feed reads the capture, handing the DHT packets to the DHT right away and
+// keeping the TCP segments until the end.
+func (r *replay) feed(pr *pcapReader) error {
+	for {
+		p, err := pr.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r.packets++
+
+		switch p.proto {
+		case ipProtoUDP:
+			if r.port == 0 || p.dstPort == r.port {
+				r.onUDP(p)
+			}
+		case ipProtoTCP:
+			r.onTCP(p)
+		}
+	}
+}
+
+func (r *replay) onUDP(p *pcapPacket) {
+	r.dhtPackets++
+	r.dht.onMessage(p.payload, net.UDPAddr{IP: p.src, Port: p.srcPort})
+
+	for ac := r.dht.announcements.get(); ac != nil; ac = r.dht.announcements.get() {
+		r.announced[ac.infohashHex] = struct{}{}
+	}
+}
+
+func (r *replay) onTCP(p *pcapPacket) {
+	key := p.srcAddr() + "->" + p.dstAddr()
+	s, ok := r.streams[key]
+	if !ok {
+		s = &tcpStream{src: p.srcAddr(), dst: p.dstAddr()}
+		r.streams[key] = s
+		r.order = append(r.order, key)
+	}
+
+	if p.flags&tcpSyn != 0 {
+		s.hasISN, s.isn = true, p.seq
+		s.opener = p.flags&tcpAck == 0
+	}
+
+	if len(p.payload) > 0 {
+		s.segments = append(s.segments, tcpSegment{seq: p.seq, data: append([]byte(nil), p.payload...)})
+	}
+}
+
+// runExchanges runs the metadata exchange of every recorded BitTorrent
+// connection over what the peer sent in it.
+func (r *replay) runExchanges() {
+	done := make(map[string]bool)
+	for _, key := range r.order {
+		if done[key] {
+			continue
+		}
+		s := r.streams[key]
+		backKey := s.dst + "->" + s.src
+		back := r.streams[backKey]
+		done[key], done[backKey] = true, true
+		r.connections++
+
+		// the peer is the side which did not open the connection or, if the
+		// capture missed the handshake, the one which sent more
+		peer := s
+		switch {
+		case back == nil && s.opener:
+			// only our side of it was captured
+			continue
+		case back == nil:
+		case s.opener:
+			peer = back
+		case back.opener:
+		case len(back.bytes()) > len(s.bytes()):
+			peer = back
+		}
+
+		data := peer.bytes()
+		if len(data) < 68 || !bytes.HasPrefix(data, []byte("\x13BitTorrent protocol")) {
+			continue
+		}
+		r.exchanges++
+
+		infohash := string(data[28:48])
+		infohashHex := hex.EncodeToString([]byte(infohash))
+		meta, err := r.exchange(infohash, peer, data)
+		if err != nil {
+			log.Printf("replayed exchange with %s for %s failed: %v", peer.src, infohashHex, err)
+			r.failures[err.Error()]++
+			continue
+		}
+		r.fetched++
+
+		var t *torrent
+		if r.index {
+			t, err = indexTorrent(meta, infohashHex)
+		} else {
+			t, err = parseTorrent(meta, infohashHex)
+		}
+		if err != nil {
+			log.Printf("error parsing replayed torrent %s: %v", infohashHex, err)
+			r.failures["parse: "+err.Error()]++
+			continue
+		}
+		r.parsed++
+		log.Println(t)
+	}
+}
+
+func (r *replay) exchange(infohash string, peer *tcpStream, data []byte) ([]byte, error) {
+	local, _ := net.ResolveTCPAddr("tcp", peer.dst)
+	remote, _ := net.ResolveTCPAddr("tcp", peer.src)
+
+	wire := newMetaWire(infohash, peer.src, 0)
+	defer wire.free()
+
+	wire.conn = &replayConn{Reader: bytes.NewReader(data), local: local, remote: remote}
+	return wire.exchange(context.Background())
+}
+
+func (r *replay) report(w io.Writer, elapsed time.Duration) {
+	stats := r.dht.stats()
+	seconds := elapsed.Seconds()
+
+	fmt.Fprintf(w, "packets: %d in %s (%.0f/s)\n", r.packets, elapsed.Round(time.Millisecond), float64(r.packets)/seconds)
+	fmt.Fprintf(w, "dht packets: %d, queries: %d, announces: %d (%d infohashes), strikes: %d\n",
+		r.dhtPackets, stats.Queries, stats.Announces, len(r.announced), stats.Strikes)
+	fmt.Fprintf(w, "tcp connections: %d, bittorrent: %d, metadata fetched: %d, torrents parsed: %d (%.0f/s)\n",
+		r.connections, r.exchanges, r.fetched, r.parsed, float64(r.parsed)/seconds)
+
+	reasons := make([]string, 0, len(r.failures))
+	for reason := range r.failures {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool { return r.failures[reasons[i]] > r.failures[reasons[j]] })
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "  %d failed: %s\n", r.failures[reason], reason)
+	}
+}
+
+func newReplayCommand() *cobra.Command {
+	var port int
+	var indexTorrents bool
+	var verbose bool
+
+	cmd := &cobra.Command{
+		Use:          "replay <file.pcap>",
+		Short:        "Feed recorded DHT traffic and metadata exchanges through the crawler, offline",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+	}
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		log.SetOutput(io.Discard)
+		if verbose {
+			log.SetOutput(os.Stdout)
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		pr, err := newPcapReader(f)
+		if err != nil {
+			return err
+		}
+
+		if indexTorrents {
+			startIndex()
+			defer index.Close()
+		}
+
+		r, err := newReplay(port, indexTorrents)
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+		if err := r.feed(pr); err != nil {
+			// still report what was replayed before the capture broke off
+			fmt.Fprintf(os.Stderr, "capture ends early: %v\n", err)
+		}
+		r.runExchanges()
+
+		r.report(os.Stdout, time.Since(start))
+		return nil
+	}
+
+	cmd.Flags().IntVarP(&port, "port", "p", 6881, "DHT port of the recorded crawler, UDP packets to other ports are skipped; 0 to replay all UDP packets")
+	cmd.Flags().BoolVar(&indexTorrents, "index", false, "store and index the replayed torrents in torsniff.index, like the crawler does")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "run in verbose mode")
+
+	return cmd
+}
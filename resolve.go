@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// resolveTimeout bounds a resolution, from the lookups for the peers of
+	// the infohash to the fetch from them.
+	resolveTimeout = 2 * time.Minute
+	// resolveRetry is the pause between lookups which found no peer, while
+	// the routing table fills up.
+	resolveRetry = 5 * time.Second
+	// maxResolveJobs bounds the resolutions running at once.
+	maxResolveJobs = 64
+	// resolveJobTTL is how long a finished job can be polled.
+	resolveJobTTL = time.Hour
+	// resolveWait is how long POST /resolve waits for the torrent by default
+	// before answering with the job to poll, maxResolveWait at most.
+	resolveWait    = 10 * time.Second
+	maxResolveWait = time.Minute
+)
+
+// status of a resolve job
+const (
+	resolvePending = "pending"
+	resolveDone    = "done"
+	resolveFailed  = "failed"
+)
+
+var errResolveBusy = errors.New("too many resolutions running")
+
+// magnetLink is what we need of a magnet link: the DHT infohash and the peers
+// it may name.
+type magnetLink struct {
+	infohash    string
+	infohashHex string
+	peers       []net.Addr
+}
+
+// parseMagnet parses a magnet link with a btih, hex or base32, or a btmh of
+// a SHA-256, whose first 20 bytes are the DHT infohash (BEP 52). A bare hex
+// infohash is taken too.
+func parseMagnet(s string) (*magnetLink, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "magnet:") {
+		return magnetInfohash(s)
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	qs, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	var m *magnetLink
+	for _, xt := range qs["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			m, err = magnetInfohash(strings.TrimPrefix(xt, "urn:btih:"))
+		case strings.HasPrefix(xt, "urn:btmh:1220") && m == nil:
+			// multihash of a SHA-256: function 0x12, length 0x20
+			v2 := strings.TrimPrefix(xt, "urn:btmh:1220")
+			if len(v2) != 64 {
+				return nil, fmt.Errorf("invalid btmh %q", xt)
+			}
+			m, err = magnetInfohash(v2[:40])
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if m == nil {
+		return nil, errors.New("magnet link without a btih or btmh")
+	}
+
+	for _, pe := range qs["x.pe"] {
+		if addr, err := net.ResolveTCPAddr("tcp", pe); err == nil {
+			m.peers = append(m.peers, addr)
+		}
+	}
+
+	return m, nil
+}
+
+func magnetInfohash(s string) (*magnetLink, error) {
+	var infohash []byte
+	var err error
+	switch len(s) {
+	case 40:
+		infohash, err = hex.DecodeString(s)
+	case 32:
+		infohash, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		err = errors.New("not 40 hex or 32 base32 digits")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid infohash %q: %v", s, err)
+	}
+
+	return &magnetLink{
+		infohash:    string(infohash),
+		infohashHex: hex.EncodeToString(infohash),
+	}, nil
+}
+
+// loadTorrent returns the indexed torrent of infohashHex, either of the
+// infohashes of a hybrid torrent, or nil if it is not indexed.
+func loadTorrent(infohashHex string) (*torrent, error) {
+	if alias, err := index.GetInternal(aliasKey(infohashHex)); err == nil && len(alias) > 0 {
+		infohashHex = string(alias)
+	}
+
+	meta, err := index.GetInternal([]byte(infohashHex))
+	if err != nil || len(meta) == 0 {
+		return nil, err
+	}
+
+	torrent, err := parseTorrent(meta, infohashHex)
+	if err != nil {
+		return nil, err
+	}
+	torrent.loadSwarm()
+	torrent.loadPreviews()
+	return torrent, nil
+}
+
+// findPeers looks up the peers of infohash with every identity, and if retry,
+// again and again until some are found or ctx is done.
+func (t *torsniff) findPeers(ctx context.Context, infohash string, retry bool) ([]net.Addr, error) {
+	for {
+		found := make(chan []*net.TCPAddr, len(t.dhts))
+		for _, d := range t.dhts {
+			d.counters.lookups.Add(1)
+			d.getPeers(infohash, func(peers []*net.TCPAddr) {
+				found <- peers
+			})
+		}
+
+		seen := make(map[string]bool)
+		var peers []net.Addr
+		for range t.dhts {
+			select {
+			case <-ctx.Done():
+				return nil, errTimeout
+			case addrs := <-found:
+				for _, addr := range addrs {
+					if !seen[addr.String()] {
+						seen[addr.String()] = true
+						peers = append(peers, addr)
+					}
+				}
+			}
+		}
+		if len(peers) > 0 {
+			return peers, nil
+		}
+		if !retry {
+			return nil, errNoPeers
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errNoPeers
+		case <-time.After(resolveRetry):
+		}
+	}
+}
+
+// resolve returns the torrent of m: from the index if we have it, otherwise
+// fetched from the peers a get_peers lookup finds, and indexed like a sniffed
+// torrent. The fetch waits for a token of the pool the announces share.
+func (t *torsniff) resolve(ctx context.Context, m *magnetLink) (*torrent, error) {
+	if torrent, err := loadTorrent(m.infohashHex); err != nil || torrent != nil {
+		return torrent, err
+	}
+
+	// if the link names peers already, a single lookup for more will do
+	peers := m.peers
+	if found, err := t.findPeers(ctx, m.infohash, len(peers) == 0); err == nil {
+		peers = append(peers, found...)
+	} else if len(peers) == 0 {
+		return nil, err
+	}
+	log.Printf("resolving %s from %d peers", m.infohashHex, len(peers))
+
+	ac := &announcement{
+		infohash:    []byte(m.infohash),
+		infohashHex: m.infohashHex,
+		peers:       peers,
+	}
+	select {
+	case t.tokens <- struct{}{}:
+	case <-ctx.Done():
+		return nil, errTimeout
+	}
+	defer func() {
+		<-t.tokens
+	}()
+
+	r, pex, err := t.fetch(ctx, ac)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.store(ac, r, pex)
+}
+
+// resolveJob is a resolution run for an HTTP client, which it can poll.
+type resolveJob struct {
+	ID       string     `json:"id"`
+	Infohash string     `json:"infohash"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Torrent  *torrent   `json:"torrent,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	done chan struct{}
+}
+
+// resolveJobs are the jobs running and those finished for resolveJobTTL.
+type resolveJobs struct {
+	mu      sync.Mutex
+	byID    map[string]*resolveJob
+	running map[string]*resolveJob // by infohash, so that a hash runs once
+}
+
+func newResolveJobs() *resolveJobs {
+	return &resolveJobs{
+		byID:    make(map[string]*resolveJob),
+		running: make(map[string]*resolveJob),
+	}
+}
+
+// start resolves m in the background, unless it is being resolved already,
+// and returns its job.
+func (jobs *resolveJobs) start(t *torsniff, m *magnetLink) (*resolveJob, error) {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	if job, ok := jobs.running[m.infohashHex]; ok {
+		return job, nil
+	}
+	if len(jobs.running) >= maxResolveJobs {
+		return nil, errResolveBusy
+	}
+
+	for id, job := range jobs.byID {
+		if job.Finished != nil && time.Since(*job.Finished) > resolveJobTTL {
+			delete(jobs.byID, id)
+		}
+	}
+
+	job := &resolveJob{
+		ID:       hex.EncodeToString(randBytes(8)),
+		Infohash: m.infohashHex,
+		Status:   resolvePending,
+		Started:  time.Now(),
+		done:     make(chan struct{}),
+	}
+	jobs.byID[job.ID] = job
+	jobs.running[m.infohashHex] = job
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		defer cancel()
+		torrent, err := t.resolve(ctx, m)
+
+		jobs.mu.Lock()
+		defer jobs.mu.Unlock()
+
+		finished := time.Now()
+		job.Finished = &finished
+		switch {
+		case err != nil:
+			job.Status = resolveFailed
+			job.Error = err.Error()
+		case torrent == nil:
+			job.Status = resolveFailed
+			job.Error = "torrent deleted while resolving"
+		default:
+			job.Status = resolveDone
+			job.Torrent = torrent
+		}
+		delete(jobs.running, m.infohashHex)
+		close(job.done)
+	}()
+
+	return job, nil
+}
+
+// get returns a copy of the job id, safe to read, or nil.
+func (jobs *resolveJobs) get(id string) *resolveJob {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	job, ok := jobs.byID[id]
+	if !ok {
+		return nil
+	}
+	c := *job
+	return &c
+}
+
+// resolveHandler resolves the infohash or magnet link h with POST, answering
+// with the torrent if it comes within wait seconds, or else with the job to
+// poll with GET and job.
+func (t *torsniff) resolveHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		job := t.resolveJobs.get(r.URL.Query().Get("job"))
+		if job == nil {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m, err := parseMagnet(r.URL.Query().Get("h"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	torrent, err := loadTorrent(m.infohashHex)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if torrent != nil {
+		writeJSON(w, http.StatusOK, torrent)
+		return
+	}
+
+	job, err := t.resolveJobs.start(t, m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	wait := time.Duration(getQSInt(r.URL.Query(), "wait", int(resolveWait/time.Second))) * time.Second
+	if wait > maxResolveWait {
+		wait = maxResolveWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-job.done:
+	case <-timer.C:
+	case <-r.Context().Done():
+		return
+	}
+
+	job = t.resolveJobs.get(job.ID)
+	switch job.Status {
+	case resolveDone:
+		writeJSON(w, http.StatusOK, job.Torrent)
+	case resolveFailed:
+		writeJSON(w, http.StatusBadGateway, job)
+	default:
+		w.Header().Set("Location", "/resolve?job="+job.ID)
+		writeJSON(w, http.StatusAccepted, job)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+func newFetchCommand() *cobra.Command {
+	var port int
+	var timeout time.Duration
+	var wait time.Duration
+	var bootstrap []string
+	var bootstrapFile string
+	var utp bool
+	var encryption string
+	var output string
+	var indexTorrents bool
+	var verbose bool
+
+	cmd := &cobra.Command{
+		Use:          "fetch <magnet or infohash>",
+		Short:        "Look up the peers of a torrent in the DHT and fetch its metadata",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+	}
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		log.SetOutput(io.Discard)
+		if verbose {
+			log.SetOutput(os.Stderr)
+		}
+
+		m, err := parseMagnet(args[0])
+		if err != nil {
+			return err
+		}
+		if !validEncryption(encryption) {
+			return fmt.Errorf("encryption must be prefer, require or disable, got %q", encryption)
+		}
+
+		seeds, err := bootstrapNodes(bootstrap, bootstrapFile)
+		if err != nil {
+			return err
+		}
+
+		if indexTorrents {
+			startIndex()
+			defer index.Close()
+		} else {
+			// resolve and fetch look into the index, give them an empty one
+			if index, err = newMemIndex(); err != nil {
+				return err
+			}
+		}
+
+		t := &torsniff{
+			laddr:      net.JoinHostPort("", fmt.Sprint(port)),
+			timeout:    timeout,
+			maxFriends: 50,
+			secret:     string(randBytes(20)),
+			blacklist:  newBlackList(5*time.Minute, 50000),
+			maxRetries: 2,
+			bootstrap:  seeds,
+			identities: 1,
+			utp:        utp,
+			encryption: encryption,
+			clients:    newClientStats(),
+		}
+		if err := t.listen(); err != nil {
+			return err
+		}
+		for _, d := range t.dhts {
+			d.run()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), wait)
+		defer cancel()
+
+		torrent, err := t.resolve(ctx, m)
+		if err != nil {
+			return fmt.Errorf("fetching %s: %v", m.infohashHex, err)
+		}
+
+		if output != "" {
+			meta, err := index.GetInternal([]byte(torrent.InfohashHex))
+			if err != nil {
+				return err
+			}
+			data, err := encodeTorrentFile(meta)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(output, data, 0644); err != nil {
+				return err
+			}
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(torrent)
+	}
+
+	cmd.Flags().IntVarP(&port, "port", "p", 0, "DHT port to listen on, 0 for any")
+	cmd.Flags().DurationVarP(&timeout, "timeout", "t", 30*time.Second, "max time allowed for downloading the metadata from a peer")
+	cmd.Flags().DurationVarP(&wait, "wait", "w", resolveTimeout, "max time to look for peers in the DHT")
+	cmd.Flags().StringSliceVar(&bootstrap, "bootstrap", nil, "bootstrap DHT nodes as host:port or hex compact node info, instead of the public routers")
+	cmd.Flags().StringVar(&bootstrapFile, "bootstrap-file", "", "file of bootstrap DHT nodes, one per line, instead of the public routers")
+	cmd.Flags().BoolVar(&utp, "utp", true, "fetch metadata over uTP (BEP 29) from peers which do not accept TCP connections")
+	cmd.Flags().StringVar(&encryption, "encryption", encryptionPrefer, "MSE/PE obfuscation of peer connections: prefer, require or disable")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "also write the .torrent file here")
+	cmd.Flags().BoolVar(&indexTorrents, "index", false, "store and index the torrent in torsniff.index, like the crawler does")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "log to stderr")
+
+	return cmd
+}
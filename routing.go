@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// bucketSize is K from the Kademlia paper, the number of nodes kept per bucket.
+	bucketSize = 8
+	// maxReplacements bounds the cache of candidates waiting for a slot in a full bucket.
+	maxReplacements = 8
+	// maxBuckets is one bucket per bit of a node ID.
+	maxBuckets = 160
+	// questionableAfter is how long a node may stay silent before we ping it.
+	questionableAfter = 15 * time.Minute
+	// maxNodeFailures is the number of unanswered queries after which a node is bad.
+	maxNodeFailures = 2
+)
+
+type bucket struct {
+	nodes        []*node // least recently seen first
+	replacements []*node // most recently seen last
+	lastChanged  time.Time
+}
+
+func (b *bucket) indexOf(id string) int {
+	for i, n := range b.nodes {
+		if n.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *bucket) addReplacement(n *node) {
+	for i, r := range b.replacements {
+		if r.id == n.id {
+			b.replacements = append(b.replacements[:i], b.replacements[i+1:]...)
+			break
+		}
+	}
+
+	b.replacements = append(b.replacements, n)
+	if len(b.replacements) > maxReplacements {
+		b.replacements = b.replacements[1:]
+	}
+}
+
+// routingTable is a Kademlia routing table as described in BEP 5. Bucket i
+// holds the nodes sharing exactly i leading bits with the local ID, except
+// for the last bucket which holds everything closer; it is split when it
+// overflows.
+type routingTable struct {
+	mu      sync.Mutex
+	localID nodeID
+	buckets []*bucket
+}
+
+func newRoutingTable(localID nodeID) *routingTable {
+	return &routingTable{
+		localID: localID,
+		buckets: []*bucket{{lastChanged: time.Now()}},
+	}
+}
+
+func commonPrefixLen(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(a) * 8
+}
+
+func distance(a, b []byte) []byte {
+	d := make([]byte, len(a))
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+func (rt *routingTable) bucketIndexLocked(id string) int {
+	i := commonPrefixLen(rt.localID, []byte(id))
+	if i >= len(rt.buckets) {
+		i = len(rt.buckets) - 1
+	}
+	return i
+}
+
+// insert records that n has been seen alive. If n's bucket is full and cannot
+// be split, n is kept as a replacement and the least recently seen node of the
+// bucket is returned if it is questionable, so the caller can ping it.
+func (rt *routingTable) insert(n *node) *node {
+	if len(n.id) != 20 {
+		return nil
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if n.id == string(rt.localID) {
+		return nil
+	}
+
+	for {
+		b := rt.buckets[rt.bucketIndexLocked(n.id)]
+
+		if i := b.indexOf(n.id); i >= 0 {
+			existing := b.nodes[i]
+			existing.addr = n.addr
+			existing.lastSeen = n.lastSeen
+			existing.failures = 0
+			if n.rtt != 0 {
+				existing.rtt = n.rtt
+			}
+			b.nodes = append(append(b.nodes[:i], b.nodes[i+1:]...), existing)
+			b.lastChanged = n.lastSeen
+			return nil
+		}
+
+		if len(b.nodes) < bucketSize {
+			b.nodes = append(b.nodes, n)
+			b.lastChanged = n.lastSeen
+			return nil
+		}
+
+		if b == rt.buckets[len(rt.buckets)-1] && len(rt.buckets) < maxBuckets {
+			rt.splitLocked()
+			continue
+		}
+
+		for i, old := range b.nodes {
+			if old.failures >= maxNodeFailures {
+				b.nodes = append(append(b.nodes[:i], b.nodes[i+1:]...), n)
+				b.lastChanged = n.lastSeen
+				return nil
+			}
+		}
+
+		b.addReplacement(n)
+
+		if oldest := b.nodes[0]; time.Since(oldest.lastSeen) > questionableAfter {
+			return oldest.copy()
+		}
+		return nil
+	}
+}
+
+// setLocalID rebuilds the table around a new local ID.
+func (rt *routingTable) setLocalID(id nodeID) {
+	rt.mu.Lock()
+	var nodes []*node
+	for _, b := range rt.buckets {
+		nodes = append(nodes, b.nodes...)
+	}
+	rt.localID = id
+	rt.buckets = []*bucket{{lastChanged: time.Now()}}
+	rt.mu.Unlock()
+
+	for _, n := range nodes {
+		rt.insert(n)
+	}
+}
+
+func (rt *routingTable) splitLocked() {
+	last := rt.buckets[len(rt.buckets)-1]
+	depth := len(rt.buckets)
+	next := &bucket{lastChanged: last.lastChanged}
+
+	var stay []*node
+	for _, n := range last.nodes {
+		if commonPrefixLen(rt.localID, []byte(n.id)) >= depth {
+			next.nodes = append(next.nodes, n)
+		} else {
+			stay = append(stay, n)
+		}
+	}
+	last.nodes = stay
+
+	var stayReplacements []*node
+	for _, n := range last.replacements {
+		if commonPrefixLen(rt.localID, []byte(n.id)) >= depth {
+			next.replacements = append(next.replacements, n)
+		} else {
+			stayReplacements = append(stayReplacements, n)
+		}
+	}
+	last.replacements = stayReplacements
+
+	rt.buckets = append(rt.buckets, next)
+}
+
+// failed records an unanswered query to the node. Bad nodes are evicted in
+// favour of the most recently seen replacement.
+func (rt *routingTable) failed(id string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	b := rt.buckets[rt.bucketIndexLocked(id)]
+	i := b.indexOf(id)
+	if i < 0 {
+		return
+	}
+
+	n := b.nodes[i]
+	n.failures++
+	if n.failures < maxNodeFailures || len(b.replacements) == 0 {
+		return
+	}
+
+	last := len(b.replacements) - 1
+	b.nodes = append(append(b.nodes[:i], b.nodes[i+1:]...), b.replacements[last])
+	b.replacements = b.replacements[:last]
+	b.lastChanged = time.Now()
+}
+
+func (rt *routingTable) remove(id string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	b := rt.buckets[rt.bucketIndexLocked(id)]
+	if i := b.indexOf(id); i >= 0 {
+		b.nodes = append(b.nodes[:i], b.nodes[i+1:]...)
+		if last := len(b.replacements) - 1; last >= 0 {
+			b.nodes = append(b.nodes, b.replacements[last])
+			b.replacements = b.replacements[:last]
+		}
+	}
+}
+
+// closest returns up to k good nodes ordered by XOR distance to target.
+func (rt *routingTable) closest(target nodeID, k int) []*node {
+	rt.mu.Lock()
+	var all []*node
+	for _, b := range rt.buckets {
+		for _, n := range b.nodes {
+			if n.failures < maxNodeFailures {
+				all = append(all, n.copy())
+			}
+		}
+	}
+	rt.mu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return bytes.Compare(distance([]byte(all[i].id), target), distance([]byte(all[j].id), target)) < 0
+	})
+
+	if len(all) > k {
+		all = all[:k]
+	}
+	return all
+}
+
+// questionable returns the nodes which have not been heard from recently.
+func (rt *routingTable) questionable() []*node {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	var nodes []*node
+	for _, b := range rt.buckets {
+		for _, n := range b.nodes {
+			if time.Since(n.lastSeen) > questionableAfter {
+				nodes = append(nodes, n.copy())
+			}
+		}
+	}
+	return nodes
+}
+
+// staleTargets returns a random ID in the range of every bucket that has not
+// changed recently; looking those up keeps the far buckets populated.
+func (rt *routingTable) staleTargets() []nodeID {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	var targets []nodeID
+	for i, b := range rt.buckets {
+		if time.Since(b.lastChanged) > questionableAfter {
+			targets = append(targets, randomIDInBucket(rt.localID, i))
+		}
+	}
+	return targets
+}
+
+// randomIDInBucket returns a random ID sharing exactly depth leading bits
+// with local.
+func randomIDInBucket(local nodeID, depth int) nodeID {
+	id := randBytes(20)
+	if depth >= 160 {
+		return append(nodeID(nil), local...)
+	}
+
+	for i := 0; i < depth; i++ {
+		mask := byte(0x80 >> uint(i%8))
+		id[i/8] = id[i/8]&^mask | local[i/8]&mask
+	}
+	mask := byte(0x80 >> uint(depth%8))
+	id[depth/8] = id[depth/8]&^mask | ^local[depth/8]&mask
+	return id
+}
+
+func (rt *routingTable) nodes() []*node {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	var nodes []*node
+	for _, b := range rt.buckets {
+		for _, n := range b.nodes {
+			nodes = append(nodes, n.copy())
+		}
+	}
+	return nodes
+}
+
+func (rt *routingTable) len() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	var count int
+	for _, b := range rt.buckets {
+		count += len(b.nodes)
+	}
+	return count
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"time"
+)
+
+const (
+	// minSampleInterval is the least time we wait before sampling a node
+	// again, whatever interval it asks for.
+	minSampleInterval = time.Minute
+	// maxSampleInterval is the largest interval allowed by BEP 51.
+	maxSampleInterval = 6 * time.Hour
+	// maxConcurrentLookups bounds the get_peers lookups run for harvested
+	// infohashes.
+	maxConcurrentLookups = 64
+)
+
+// canSample reports whether the node at addr may be sent a sample_infohashes
+// query now, and if so reserves it until the node tells us its interval.
+func (d *dht) canSample(addr string) bool {
+	d.sampleMu.Lock()
+	defer d.sampleMu.Unlock()
+
+	now := time.Now()
+	if next, ok := d.nextSample[addr]; ok && now.Before(next) {
+		return false
+	}
+
+	d.nextSample[addr] = now.Add(minSampleInterval)
+	return true
+}
+
+func (d *dht) sampleAfter(addr string, interval time.Duration) {
+	if interval < minSampleInterval {
+		interval = minSampleInterval
+	}
+	if interval > maxSampleInterval {
+		interval = maxSampleInterval
+	}
+
+	d.sampleMu.Lock()
+	defer d.sampleMu.Unlock()
+
+	d.nextSample[addr] = time.Now().Add(interval)
+}
+
+// pruneSamples forgets the nodes which may be sampled again.
+func (d *dht) pruneSamples() {
+	d.sampleMu.Lock()
+	defer d.sampleMu.Unlock()
+
+	now := time.Now()
+	for addr, next := range d.nextSample {
+		if now.After(next) {
+			delete(d.nextSample, addr)
+		}
+	}
+}
+
+// sampleInfohashes sends a BEP 51 sample_infohashes query. The reply also
+// carries nodes like find_node, so it doubles as a crawl step.
+func (d *dht) sampleInfohashes(to string, target nodeID) {
+	addr, err := net.ResolveUDPAddr("udp", to)
+	if err != nil {
+		return
+	}
+
+	d.query(*addr, "sample_infohashes", map[string]interface{}{
+		"id":     d.idFor(target),
+		"target": string(randBytes(20)),
+		"want":   d.want(),
+	}, &transaction{id: string(target)})
+}
+
+func (d *dht) onSamples(r map[string]interface{}, from net.UDPAddr) {
+	samples, ok := r["samples"].(string)
+	if !ok || len(samples)%20 != 0 {
+		return
+	}
+
+	if interval, ok := r["interval"].(int64); ok {
+		d.sampleAfter(from.String(), time.Duration(interval)*time.Second)
+	}
+
+	d.counters.samples.Add(uint64(len(samples) / 20))
+	for i := 0; i < len(samples); i += 20 {
+		d.resolve(samples[i:i+20], from)
+	}
+}
+
+// resolve finds peers for an infohash we learnt about without an announce
+// and queues an announcement for each of them.
+func (d *dht) resolve(infohash string, from net.UDPAddr) {
+	// a replay has no network to look up in
+	if d.replay {
+		return
+	}
+
+	infohashHex := hex.EncodeToString([]byte(infohash))
+	if d.harvested.has(infohashHex) || d.announcements.full() {
+		return
+	}
+
+	select {
+	case d.lookupSlots <- struct{}{}:
+	default:
+		return
+	}
+	d.harvested.add(infohashHex)
+	d.counters.lookups.Add(1)
+
+	d.getPeers(infohash, func(peers []*net.TCPAddr) {
+		<-d.lookupSlots
+
+		if len(peers) == 0 {
+			return
+		}
+
+		ac := &announcement{
+			from:        from,
+			infohash:    []byte(infohash),
+			infohashHex: infohashHex,
+		}
+		for _, peer := range peers {
+			ac.peers = append(ac.peers, peer)
+		}
+		d.announcements.put(ac)
+	})
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search"
+)
+
+const (
+	// scrapeBatch is the number of torrents scraped per scrapeTick.
+	scrapeBatch = 32
+	scrapeTick  = time.Minute
+)
+
+// bloomFilter is the 2048 bit bloom filter of BEP 33 in which nodes record the
+// peers of an infohash.
+type bloomFilter [256]byte
+
+// merge adds the peers of a filter received from a node, and reports whether
+// it was a filter at all.
+func (b *bloomFilter) merge(s string) bool {
+	if len(s) != len(b) {
+		return false
+	}
+	for i := range b {
+		b[i] |= s[i]
+	}
+	return true
+}
+
+// estimate returns the approximate number of peers in the filter.
+func (b *bloomFilter) estimate() int {
+	const m, k = 256 * 8, 2
+
+	zeros := 0
+	for _, c := range b {
+		for i := 0; i < 8; i++ {
+			if c&(1<<i) == 0 {
+				zeros++
+			}
+		}
+	}
+
+	// a full filter only tells us the swarm is at least this big
+	if zeros == 0 {
+		zeros = 1
+	}
+
+	return int(math.Round(math.Log(float64(zeros)/m) / (k * math.Log(1-1.0/m))))
+}
+
+// swarm is the result of the last scrape of a torrent, kept as internal data
+// of the index next to the metadata.
+type swarm struct {
+	Seeders   int       `json:"seeders"`
+	Leechers  int       `json:"leechers"`
+	ScrapedAt time.Time `json:"scrapedAt"`
+}
+
+func swarmKey(infohashHex string) []byte {
+	return []byte("swarm:" + infohashHex)
+}
+
+// loadSwarm fills in the result of the last scrape of t, if any.
+func (t *torrent) loadSwarm() {
+	data, err := index.GetInternal(swarmKey(t.InfohashHex))
+	if err != nil || len(data) == 0 {
+		return
+	}
+
+	var s swarm
+	if err := json.Unmarshal(data, &s); err != nil {
+		return
+	}
+
+	t.Seeders = s.Seeders
+	t.Leechers = s.Leechers
+	if !s.ScrapedAt.IsZero() {
+		// not just estimated from PEX
+		t.ScrapedAt = &s.ScrapedAt
+	}
+}
+
+// storeSwarm records a scrape of the torrent and reindexes it, so that search
+// results can be sorted and filtered by seeders and leechers.
+func storeSwarm(infohashHex string, s swarm) error {
+	meta, err := index.GetInternal([]byte(infohashHex))
+	if err != nil || len(meta) == 0 {
+		// deleted while we were scraping
+		return err
+	}
+
+	torrent, err := parseTorrent(meta, infohashHex)
+	if err != nil {
+		return err
+	}
+	torrent.Seeders = s.Seeders
+	torrent.Leechers = s.Leechers
+	if !s.ScrapedAt.IsZero() {
+		torrent.ScrapedAt = &s.ScrapedAt
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err := index.SetInternal(swarmKey(infohashHex), data); err != nil {
+		return err
+	}
+	return index.Index(infohashHex, torrent)
+}
+
+// scrapeLoop periodically scrapes the torrents which were never scraped or
+// not for interval, the least recently scraped first.
+func (t *torsniff) scrapeLoop(interval time.Duration) {
+	ticker := time.NewTicker(scrapeTick)
+	defer ticker.Stop()
+
+	for next := 0; ; {
+		<-ticker.C
+
+		due, err := dueForScrape(interval)
+		if err != nil {
+			log.Printf("error finding torrents to scrape: %v", err)
+			continue
+		}
+
+		var wg sync.WaitGroup
+		for _, infohashHex := range due {
+			infohash, err := hex.DecodeString(infohashHex)
+			if err != nil || len(infohash) != 20 {
+				continue
+			}
+
+			// spread the scrapes over the identities
+			d := t.dhts[next%len(t.dhts)]
+			next++
+
+			wg.Add(1)
+			infohashHex := infohashHex
+			d.scrape(string(infohash), func(seeders, leechers int, replied bool) {
+				defer wg.Done()
+
+				// keep the last scrape rather than record a dead swarm,
+				// the torrent stays due and is tried again
+				if !replied {
+					log.Printf("no node scraped %s", infohashHex)
+					return
+				}
+
+				s := swarm{Seeders: seeders, Leechers: leechers, ScrapedAt: time.Now()}
+				if err := storeSwarm(infohashHex, s); err != nil {
+					log.Printf("error storing scrape of %s: %v", infohashHex, err)
+					return
+				}
+				log.Printf("scraped %s: %d seeders, %d leechers", infohashHex, seeders, leechers)
+			})
+		}
+		wg.Wait()
+	}
+}
+
+// dueForScrape returns up to scrapeBatch torrents not scraped for interval.
+func dueForScrape(interval time.Duration) ([]string, error) {
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+	req.Size = scrapeBatch
+	req.Fields = []string{"scrapedAt"}
+	req.SortByCustom(search.SortOrder{&search.SortField{
+		Field:   "scrapedAt",
+		Type:    search.SortFieldAsDate,
+		Missing: search.SortFieldMissingFirst,
+	}})
+
+	results, err := index.Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var due []string
+	for _, hit := range results.Hits {
+		if s, ok := hit.Fields["scrapedAt"].(string); ok {
+			if at, err := time.Parse(time.RFC3339, s); err == nil && time.Since(at) < interval {
+				// sorted by age, so the rest is recent too
+				break
+			}
+		}
+		due = append(due, hit.ID)
+	}
+
+	return due, nil
+}
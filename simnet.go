@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// simQueueSize is the number of packets a simulated socket buffers before it
+// drops, like a full UDP receive buffer.
+const simQueueSize = 256
+
+var errSimClosed = errors.New("use of closed simulated connection")
+
+// simNetwork is an in-memory packet network, so that many DHT identities can
+// run in one process with no network access. Packets are delayed by latency
+// plus up to jitter and lost with probability loss.
+type simNetwork struct {
+	latency time.Duration
+	jitter  time.Duration
+	loss    float64
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	conns map[string]*simConn
+
+	sent          atomic.Uint64
+	lost          atomic.Uint64 // dropped by loss or a full queue
+	undeliverable atomic.Uint64 // sent to an address nobody listens on
+}
+
+type simPacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// simConn is a socket of a simNetwork, a transport.
+type simConn struct {
+	network   *simNetwork
+	addr      *net.UDPAddr
+	in        chan simPacket
+	die       chan struct{}
+	closeOnce sync.Once
+}
+
+func newSimNetwork(latency, jitter time.Duration, loss float64) *simNetwork {
+	return &simNetwork{
+		latency: latency,
+		jitter:  jitter,
+		loss:    loss,
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		conns:   make(map[string]*simConn),
+	}
+}
+
+// listen opens a socket at addr.
+func (n *simNetwork) listen(addr *net.UDPAddr) (*simConn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.conns[addr.String()]; ok {
+		return nil, fmt.Errorf("simulated address %s already in use", addr)
+	}
+
+	c := &simConn{
+		network: n,
+		addr:    addr,
+		in:      make(chan simPacket, simQueueSize),
+		die:     make(chan struct{}),
+	}
+	n.conns[addr.String()] = c
+	return c, nil
+}
+
+func (n *simNetwork) deliver(data []byte, from, to *net.UDPAddr) {
+	n.sent.Add(1)
+
+	n.mu.Lock()
+	c := n.conns[to.String()]
+	lost := n.rng.Float64() < n.loss
+	delay := n.latency
+	if n.jitter > 0 {
+		delay += time.Duration(n.rng.Int63n(int64(n.jitter)))
+	}
+	n.mu.Unlock()
+
+	if c == nil {
+		n.undeliverable.Add(1)
+		return
+	}
+	if lost {
+		n.lost.Add(1)
+		return
+	}
+
+	p := simPacket{data: append([]byte(nil), data...), from: from}
+	time.AfterFunc(delay, func() {
+		select {
+		case c.in <- p:
+		default:
+			n.lost.Add(1)
+		}
+	})
+}
+
+func (c *simConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-c.in:
+		return copy(p, packet.data), packet.from, nil
+	case <-c.die:
+		return 0, nil, errSimClosed
+	}
+}
+
+func (c *simConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.die:
+		return 0, errSimClosed
+	default:
+	}
+
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("simulated network only carries UDP, not %s", addr.Network())
+	}
+
+	c.network.deliver(p, c.addr, to)
+	return len(p), nil
+}
+
+func (c *simConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *simConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.die)
+
+		c.network.mu.Lock()
+		delete(c.network.conns, c.addr.String())
+		c.network.mu.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+// dhtState is what we keep of the DHT across restarts, so that we come back
+// with the same node ID and can skip bootstrapping from the public routers.
+type dhtState struct {
+	ID    string      `json:"id"`
+	Nodes []stateNode `json:"nodes"`
+}
+
+type stateNode struct {
+	ID       string    `json:"id"`
+	Addr     string    `json:"addr"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+func loadState(path string) (*dhtState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &dhtState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+
+	if id, err := hex.DecodeString(state.ID); err != nil || len(id) != 20 {
+		state.ID = ""
+	}
+
+	return state, nil
+}
+
+// restore adopts the node ID of a saved state, if any, and returns the saved
+// nodes.
+func (s *dhtState) restore() (nodeID, []*node) {
+	var id nodeID
+	if s.ID != "" {
+		id, _ = hex.DecodeString(s.ID)
+	}
+
+	var nodes []*node
+	for _, n := range s.Nodes {
+		nid, err := hex.DecodeString(n.ID)
+		if err != nil || len(nid) != 20 {
+			continue
+		}
+		nodes = append(nodes, &node{id: string(nid), addr: n.Addr, lastSeen: n.LastSeen})
+	}
+
+	return id, nodes
+}
+
+// saveState writes the node ID and the good nodes of the routing tables to
+// path, replacing the previous state atomically.
+func (d *dht) saveState(path string) error {
+	state := dhtState{ID: hex.EncodeToString(d.id())}
+	for _, table := range d.tables() {
+		for _, n := range table.nodes() {
+			if n.failures > 0 {
+				continue
+			}
+			state.Nodes = append(state.Nodes, stateNode{
+				ID:       hex.EncodeToString([]byte(n.id)),
+				Addr:     n.addr,
+				LastSeen: n.lastSeen,
+			})
+		}
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	log.Printf("saved DHT state with %d nodes to %s", len(state.Nodes), path)
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"sync/atomic"
+)
+
+// dhtStats counts what a single DHT identity has seen.
+type dhtStats struct {
+	queries   atomic.Uint64 // queries received
+	replies   atomic.Uint64 // replies received to our queries
+	announces atomic.Uint64 // valid announce_peer queries received
+	samples   atomic.Uint64 // infohashes received in sample_infohashes replies
+	lookups   atomic.Uint64 // get_peers lookups started
+
+	// nodes with and without a BEP 42 compliant ID, counted once an hour
+	compliant    atomic.Uint64
+	nonCompliant atomic.Uint64
+}
+
+// identityStats is the snapshot of a DHT identity served over HTTP.
+type identityStats struct {
+	ID           string   `json:"id"`
+	Addrs        []string `json:"addrs"`
+	Nodes        int      `json:"nodes"`
+	Outstanding  int      `json:"outstanding"`
+	Queries      uint64   `json:"queries"`
+	Replies      uint64   `json:"replies"`
+	Announces    uint64   `json:"announces"`
+	Samples      uint64   `json:"samples"`
+	Lookups      uint64   `json:"lookups"`
+	Unsolicited  uint64   `json:"unsolicited"`
+	Forged       uint64   `json:"forged"`
+	Timeouts     uint64   `json:"timeouts"`
+	Compliant    uint64   `json:"compliant"`
+	NonCompliant uint64   `json:"nonCompliant"`
+	RateLimited  uint64   `json:"rateLimited"`
+	BannedDrops  uint64   `json:"bannedDrops"`
+	Strikes      uint64   `json:"strikes"`
+	Bans         uint64   `json:"bans"`
+}
+
+func (d *dht) stats() identityStats {
+	s := identityStats{
+		ID:           hex.EncodeToString(d.id()),
+		Nodes:        d.peerCount(),
+		Outstanding:  d.transactions.len(),
+		Queries:      d.counters.queries.Load(),
+		Replies:      d.counters.replies.Load(),
+		Announces:    d.counters.announces.Load(),
+		Samples:      d.counters.samples.Load(),
+		Lookups:      d.counters.lookups.Load(),
+		Unsolicited:  d.transactions.unsolicited.Load(),
+		Forged:       d.transactions.forged.Load(),
+		Timeouts:     d.transactions.timeouts.Load(),
+		Compliant:    d.counters.compliant.Load(),
+		NonCompliant: d.counters.nonCompliant.Load(),
+		RateLimited:  d.guard.limited.Load(),
+		BannedDrops:  d.guard.dropped.Load(),
+		Strikes:      d.guard.strikes.Load(),
+		Bans:         d.guard.bans.Load(),
+	}
+
+	for _, conn := range []transport{d.conn, d.conn6} {
+		if conn != nil {
+			s.Addrs = append(s.Addrs, conn.LocalAddr().String())
+		}
+	}
+
+	return s
+}
+
+// maxIdentities bounds the DHT identities one crawler runs, each of which
+// takes a port and a routing table.
+const maxIdentities = 256
+
+// spreadID returns a random node ID in the i-th of n equal slices of the
+// keyspace, so that n identities cover it evenly. n is at most
+// maxIdentities, which leaves every slice 256 prefixes wide.
+func spreadID(i, n int) nodeID {
+	n = min(max(n, 1), maxIdentities)
+	i %= n
+
+	id := randBytes(20)
+	width := 0x10000 / n
+	prefix := i*width + int(binary.BigEndian.Uint16(id))%width
+	binary.BigEndian.PutUint16(id, uint16(prefix))
+	return id
+}
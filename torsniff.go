@@ -2,10 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"math/rand"
 	"net"
 	"os"
@@ -34,12 +34,26 @@ type torrent struct {
 	Length      int64    `json:"length"`
 	Files       []*tfile `json:"files"`
 	IndexType   string   `json:"indexType"`
+
+	// BEP 52: the SHA-1 of a v1 or hybrid torrent and the full SHA-256 of a
+	// v2 or hybrid one, whichever apply
+	InfohashV1 string `json:"infohashV1,omitempty"`
+	InfohashV2 string `json:"infohashV2,omitempty"`
+	Magnet     string `json:"magnet"`
+
+	// swarm estimate of the last BEP 33 scrape, if any
+	Seeders   int        `json:"seeders"`
+	Leechers  int        `json:"leechers"`
+	ScrapedAt *time.Time `json:"scrapedAt,omitempty"`
+
+	// files with a preview, if any
+	Previews []string `json:"previews,omitempty"`
 }
 
 func (t *torrent) String() string {
 	return fmt.Sprintf(
 		"link: %s\nname: %s\nsize: %d\nfile: %d\n",
-		fmt.Sprintf("magnet:?xt=urn:btih:%s", t.InfohashHex),
+		t.magnet(),
 		t.Name,
 		t.Length,
 		len(t.Files),
@@ -55,6 +69,7 @@ func parseTorrent(meta []byte, infohashHex string) (*torrent, error) {
 	}
 
 	t := &torrent{InfohashHex: infohashHex}
+	t.infohashes(meta, dict)
 	if name, ok := dict["name.utf-8"].(string); ok {
 		t.Name = name
 	} else if name, ok := dict["name"].(string); ok {
@@ -88,7 +103,13 @@ func parseTorrent(meta []byte, infohashHex string) (*torrent, error) {
 		t.Files = append(t.Files, &tfile{Name: filename, Length: filelength})
 	}
 
-	if files, ok := dict["files"].([]interface{}); ok {
+	if tree, ok := dict["file tree"].(map[string]interface{}); ok {
+		// v2 and hybrid torrents, which also list padding files in "files"
+		for _, f := range fileTree(tree, nil) {
+			totalSize += f.Length
+			t.Files = append(t.Files, f)
+		}
+	} else if files, ok := dict["files"].([]interface{}); ok {
 		for _, file := range files {
 			if f, ok := file.(map[string]interface{}); ok {
 				extractFiles(f)
@@ -104,6 +125,7 @@ func parseTorrent(meta []byte, infohashHex string) (*torrent, error) {
 	}
 
 	t.IndexType = "torrent"
+	t.Magnet = t.magnet()
 
 	// log.Printf("Parsed torrent: %+v", t)
 	return t, nil
@@ -117,27 +139,116 @@ type torsniff struct {
 	timeout    time.Duration
 	blacklist  *blackList
 	maxRetries int // New field for max retries
+	sample     bool
+	statePath  string
+	bootstrap  []*node
+	identities int
+	bep42      bool
+	externalIP net.IP
+	ipRate     int
+	netRate    int
+	scrape     time.Duration // interval between scrapes of a torrent, 0 to disable
+	utp        bool          // fall back to uTP for peers which do not take TCP
+	encryption string        // MSE mode, encryptionPrefer, encryptionRequire or encryptionDisable
+
+	// largest file to preview, 0 to disable
+	previewSize int64
+
+	transports transportStats
+	clients    *clientStats
+
+	resolveJobs *resolveJobs
+
+	dhts          []*dht
+	announcements *announcements
+
+	// a token for every fetch running, maxPeers at most, whether of an
+	// announce or of a resolution
+	tokens chan struct{}
+	// a token for every preview downloading, maxPreviews at most
+	previews chan struct{}
 }
 
-func (t *torsniff) run() error {
-	tokens := make(chan struct{}, t.maxPeers)
+// listen opens the sockets of every DHT identity, so that startup errors are
+// reported before running. Identity i listens on the given port plus i and
+// gets an ID in the i-th slice of the keyspace, so that together they receive
+// announces for more infohashes.
+func (t *torsniff) listen() error {
+	host, portStr, err := net.SplitHostPort(t.laddr)
+	if err != nil {
+		return err
+	}
 
-	dht, err := newDHT(t.laddr, t.maxFriends)
+	port, err := strconv.Atoi(portStr)
 	if err != nil {
 		return err
 	}
 
-	dht.run()
+	t.announcements = newAnnouncements(t.maxFriends * 10)
+	t.tokens = make(chan struct{}, max(t.maxPeers, 1))
+	t.previews = make(chan struct{}, maxPreviews)
+	t.announcements.skip = t.isTorrentExist
+	harvested := newBlackList(time.Hour, 100000)
+
+	for i := 0; i < t.identities; i++ {
+		statePath := t.statePath
+		if statePath != "" && i > 0 {
+			statePath = fmt.Sprintf("%s.%d", statePath, i)
+		}
+
+		var localID nodeID
+		if t.identities > 1 {
+			localID = spreadID(i, t.identities)
+		}
+
+		dht, err := newDHT(dhtConfig{
+			laddr:            net.JoinHostPort(host, strconv.Itoa(port+i)),
+			maxFriendsPerSec: t.maxFriends,
+			sample:           t.sample,
+			statePath:        statePath,
+			bootstrap:        t.bootstrap,
+			localID:          localID,
+			bep42:            t.bep42,
+			bep42Salt:        byte(i % 8),
+			externalIP:       t.externalIP,
+			maxPacketsPerIP:  t.ipRate,
+			maxPacketsPerNet: t.netRate,
+			announcements:    t.announcements,
+			harvested:        harvested,
+		})
+		if err != nil {
+			return err
+		}
+
+		t.dhts = append(t.dhts, dht)
+	}
+
+	return nil
+}
+
+func (t *torsniff) run() error {
+	die := make(chan error, len(t.dhts))
+	for _, d := range t.dhts {
+		d.run()
+		go func(d *dht) {
+			<-d.die
+			die <- d.errDie
+		}(d)
+	}
 
 	log.Println("running, it may take a few minutes...")
 
+	if t.scrape > 0 {
+		go t.scrapeLoop(t.scrape)
+	}
+
 	ticker := time.NewTicker(5 * time.Second)
 
 	go func() {
 		var lastCount int
 		for {
 			<-ticker.C
-			count := dht.peerCount()
+			count := t.peerCount()
 			if count > lastCount {
 				log.Printf("got %d peers (+%d)", count, count-lastCount)
 				lastCount = count
@@ -147,26 +258,44 @@ func (t *torsniff) run() error {
 
 	for {
 		select {
-		case <-dht.announcements.wait():
+		case <-t.announcements.wait():
+			// take a token first, so that the queue rather than the order of
+			// arrival decides what is fetched next
 			for {
-				if ac := dht.announcements.get(); ac != nil {
-					tokens <- struct{}{}
-					go t.work(ac, tokens)
-					continue
+				t.tokens <- struct{}{}
+				ac := t.announcements.get()
+				if ac == nil {
+					<-t.tokens
+					break
 				}
-				break
+				go t.work(ac)
 			}
-		case <-dht.die:
-			return dht.errDie
+		case err := <-die:
+			return err
 		}
 	}
 
 }
 
-func (t *torsniff) work(ac *announcement, tokens chan struct{}) {
+func (t *torsniff) peerCount() int {
+	var count int
+	for _, dht := range t.dhts {
+		count += dht.peerCount()
+	}
+	return count
+}
+
+// save persists the state of every DHT identity.
+func (t *torsniff) save() {
+	for _, dht := range t.dhts {
+		dht.save()
+	}
+}
+
+func (t *torsniff) work(ac *announcement) {
 	log.Printf("Processing announcement for infohash: %s", ac.infohashHex)
 	defer func() {
-		<-tokens
+		<-t.tokens
 	}()
 
 	if t.isTorrentExist(ac.infohashHex) {
@@ -174,56 +303,78 @@ func (t *torsniff) work(ac *announcement, tokens chan struct{}) {
 		return
 	}
 
-	peerAddr := ac.peer.String()
-	if t.blacklist.has(peerAddr) {
-		log.Printf("peer %s already blacklisted", peerAddr)
+	r, pex, err := t.fetch(context.Background(), ac)
+	if err != nil {
+		log.Printf("no peer of %s gave us its metadata: %v", ac.infohashHex, err)
 		return
 	}
 
-	var meta []byte
-	var err error
-
-	for attempt := 1; attempt <= t.maxRetries; attempt++ { // Use the maxRetries field
-		wire := newMetaWire(string(ac.infohash), peerAddr, t.timeout)
-		defer wire.free()
-
-		meta, err = wire.fetch()
-		if err == nil {
-			break
-		}
+	torrent, err := t.store(ac, r, pex)
+	if err != nil {
+		log.Printf("error indexing torrent: %v", err)
+		return
+	}
 
-		log.Printf("Attempt %d to fetch meta failed for peer %s: %v", attempt, peerAddr, err)
+	log.Println(torrent)
+}
 
-		// Exponential backoff delay
-		backoffDuration := time.Duration(math.Pow(2, float64(attempt))) * time.Second
-		log.Printf("Waiting for %v before retrying...", backoffDuration)
-		time.Sleep(backoffDuration)
+// store indexes the torrent of ac fetched from the peer of r, with what else
+// the peers told us about it.
+func (t *torsniff) store(ac *announcement, r fetchResult, pex map[string]bool) (*torrent, error) {
+	torrent, err := indexTorrent(r.meta, ac.infohashHex)
+	if err != nil {
+		return nil, err
 	}
 
-	if err != nil {
-		log.Printf("adding peer %s to blacklist after %d failed attempts", peerAddr, t.maxRetries)
-		t.blacklist.add(peerAddr)
-		return
+	if len(pex) > 0 {
+		pexSwarm(ac.infohashHex, pex)
+	}
+	if t.previewSize > 0 {
+		// in the background, so that the fetch gives back its token, and
+		// skipped rather than queued when maxPreviews are running
+		select {
+		case t.previews <- struct{}{}:
+			go func() {
+				defer func() {
+					<-t.previews
+				}()
+				t.preview(string(ac.infohash), torrent, r.meta, r.peer)
+			}()
+		default:
+			log.Printf("too many previews running, none of %s", ac.infohashHex)
+		}
 	}
 
-	torrent, err := parseTorrent(meta, ac.infohashHex)
+	return torrent, nil
+}
+
+// indexTorrent parses the metadata of infohashHex and stores and indexes it.
+func indexTorrent(meta []byte, infohashHex string) (*torrent, error) {
+	torrent, err := parseTorrent(meta, infohashHex)
 	if err != nil {
-		log.Printf("error parsing torrent: %v", err)
-		return
+		return nil, err
 	}
 
 	log.Printf("Indexing torrent: %s", torrent.InfohashHex)
 
-	index.SetInternal([]byte(ac.infohashHex), meta)
+	index.SetInternal([]byte(infohashHex), meta)
 
-	// index the torrent
-	index.Index(torrent.InfohashHex, torrent)
+	// a hybrid torrent is announced under its v1 and its v2 infohash
+	if alias := torrent.aliasHex(); alias != "" {
+		index.SetInternal(aliasKey(alias), []byte(torrent.InfohashHex))
+	}
 
-	log.Println(torrent)
+	// index the torrent
+	return torrent, index.Index(torrent.InfohashHex, torrent)
 }
 
 func (t *torsniff) isTorrentExist(infohashHex string) bool {
 	data, err := index.GetInternal([]byte(infohashHex))
+	if err == nil && len(data) > 0 {
+		return true
+	}
+
+	data, err = index.GetInternal(aliasKey(infohashHex))
 	return err == nil && len(data) > 0
 }
 
@@ -239,6 +390,19 @@ func main() {
 	var httpPort int
 	var maxRetries int
 	var enableHTTPPortMapping bool // New variable for enabling HTTP port mapping
+	var sample bool
+	var statePath string
+	var bootstrap []string
+	var bootstrapFile string
+	var identities int
+	var bep42 bool
+	var ipRate int
+	var netRate int
+	var scrapeInterval time.Duration
+	var utp bool
+	var encryption string
+	var previewSize int64
+	var p *torsniff
 
 	fmt.Println("starting...")
 
@@ -254,6 +418,11 @@ func main() {
 			log.SetOutput(os.Stdout)
 		}
 
+		seeds, err := bootstrapNodes(bootstrap, bootstrapFile)
+		if err != nil {
+			return err
+		}
+
 		startIndex()
 
 		// Create a new random generator
@@ -262,8 +431,19 @@ func main() {
 			port = rng.Intn(1000) + 6000 // Random port between 6000 and 6999
 			log.Printf("No DHT port specified, using random port: %d", port)
 		}
-		portMappings := []PortMapping{
-			{Port: int(port), Protocol: "UDP"},
+		if !validEncryption(encryption) {
+			return fmt.Errorf("encryption must be prefer, require or disable, got %q", encryption)
+		}
+		if identities < 1 || identities > maxIdentities {
+			return fmt.Errorf("identities must be between 1 and %d, got %d", maxIdentities, identities)
+		}
+		if bep42 && identities > maxBEP42Identities {
+			return fmt.Errorf("--bep42 derives at most %d distinct node IDs, got %d identities", maxBEP42Identities, identities)
+		}
+
+		var portMappings []PortMapping
+		for i := 0; i < identities; i++ {
+			portMappings = append(portMappings, PortMapping{Port: int(port) + i, Protocol: "UDP"})
 		}
 
 		// Conditionally add HTTP port mapping
@@ -271,12 +451,12 @@ func main() {
 			portMappings = append(portMappings, PortMapping{Port: httpPort, Protocol: "TCP"})
 		}
 
-		err := SetupPortForwarding(portMappings)
+		externalIP, err := SetupPortForwarding(portMappings)
 		if err != nil {
 			log.Printf("Warning: Failed to set up port forwarding: %v", err)
 		}
 
-		p := &torsniff{
+		p = &torsniff{
 			laddr:      net.JoinHostPort(addr, strconv.Itoa(int(port))),
 			timeout:    timeout,
 			maxFriends: friends,
@@ -284,10 +464,29 @@ func main() {
 			secret:     string(randBytes(20)),
 			blacklist:  newBlackList(5*time.Minute, 50000),
 			maxRetries: maxRetries,
+			sample:     sample,
+			statePath:  statePath,
+			bootstrap:  seeds,
+			identities: identities,
+			bep42:      bep42,
+			externalIP: externalIP,
+			ipRate:     ipRate,
+			netRate:    netRate,
+			scrape:     scrapeInterval,
+			utp:        utp,
+			encryption: encryption,
+			clients:    newClientStats(),
+
+			previewSize: previewSize,
+
+			resolveJobs: newResolveJobs(),
+		}
+		if err := p.listen(); err != nil {
+			return err
 		}
 		go p.run()
 
-		startHTTP(httpPort) // Pass the HTTP port to startHTTP
+		startHTTP(httpPort, p) // Pass the HTTP port to startHTTP
 
 		return nil
 	}
@@ -299,14 +498,34 @@ func main() {
 	root.Flags().DurationVarP(&timeout, "timeout", "t", 30*time.Second, "max time allowed for downloading torrents")
 	root.Flags().BoolVarP(&verbose, "verbose", "v", true, "run in verbose mode")
 	root.Flags().IntVarP(&httpPort, "http-port", "H", 8090, "HTTP server port")
-	root.Flags().IntVarP(&maxRetries, "max-retries", "r", 3, "maximum number of retries to fetch metadata") // New flag for max retries
-
+	root.Flags().IntVarP(&maxRetries, "max-retries", "r", 3, "maximum number of attempts to fetch metadata from a peer which accepts the connection") // New flag for max retries
+
+	root.Flags().BoolVarP(&sample, "sample", "s", false, "actively crawl infohashes with BEP 51 sample_infohashes")
+	root.Flags().StringVar(&statePath, "state", "torsniff.dht", "file to persist the DHT node ID and routing table in, empty to disable")
+	root.Flags().StringSliceVar(&bootstrap, "bootstrap", nil, "bootstrap DHT nodes as host:port or hex compact node info, instead of the public routers")
+	root.Flags().StringVar(&bootstrapFile, "bootstrap-file", "", "file of bootstrap DHT nodes, one per line, instead of the public routers")
+	root.Flags().IntVar(&identities, "identities", 1, "number of DHT identities to run, spread over the keyspace, on consecutive ports, at most 256")
+	root.Flags().BoolVar(&bep42, "bep42", false, "derive the DHT node IDs from our external IP and ignore nodes with non-compliant IDs (BEP 42), with 8 identities at most")
+	root.Flags().IntVar(&ipRate, "max-packets-per-ip", 50, "max DHT packets per second accepted from a single IP, 0 for no limit")
+	root.Flags().IntVar(&netRate, "max-packets-per-subnet", 200, "max DHT packets per second accepted from a single /24 or /48, 0 for no limit")
+	root.Flags().DurationVar(&scrapeInterval, "scrape-interval", 6*time.Hour, "how often to estimate the seeders and leechers of each indexed torrent with a BEP 33 scrape, 0 to disable")
+	root.Flags().BoolVar(&utp, "utp", true, "fetch metadata over uTP (BEP 29) from peers which do not accept TCP connections")
+	root.Flags().StringVar(&encryption, "encryption", encryptionPrefer, "MSE/PE obfuscation of peer connections: prefer, require or disable")
+	root.Flags().Int64Var(&previewSize, "preview-size", 0, "download the text and image files of new torrents up to this many bytes, for previews, 0 to disable")
 	root.Flags().BoolVarP(&enableHTTPPortMapping, "enable-http-port-mapping", "m", false, "enable HTTP port mapping for UPnP") // New flag with short option
 
+	root.AddCommand(newReplayCommand())
+	root.AddCommand(newFetchCommand())
+
 	if err := root.Execute(); err != nil {
 		log.Fatal(fmt.Errorf("could not start: %s", err))
 	}
 
+	// a subcommand ran to completion, there is no crawler to wait for
+	if p == nil {
+		return
+	}
+
 	// wait for signal to shut down
 	sigs := make(chan os.Signal, 1)
 
@@ -315,6 +534,9 @@ func main() {
 	sig := <-sigs
 	log.Printf("we get signal! %s", sig)
 
+	log.Println("saving DHT state...")
+	p.save()
+
 	log.Println("closing index...")
 	index.Close()
 	fmt.Println("exiting...")
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// transactionTimeout is how long we wait for the reply to a query.
+	transactionTimeout = 10 * time.Second
+	// maxTransactions bounds the outstanding queries; new ones are not sent
+	// beyond it.
+	maxTransactions = 1 << 16
+)
+
+// transaction is an outstanding query waiting for its reply.
+type transaction struct {
+	tid       string
+	query     string
+	to        net.UDPAddr
+	id        string // the node ID we expect to answer, empty if unknown
+	sent      time.Time
+	onReply   func(r map[string]interface{}) // optional
+	onFailure func()                         // optional, on timeout or error reply
+}
+
+type transactions struct {
+	mu          sync.Mutex
+	m           map[string]*transaction
+	unsolicited atomic.Uint64 // replies to no outstanding query
+	forged      atomic.Uint64 // replies from another address than the one queried
+	timeouts    atomic.Uint64
+}
+
+func newTransactions() *transactions {
+	return &transactions{
+		m: make(map[string]*transaction),
+	}
+}
+
+// add registers tx under a fresh transaction ID, which it returns, or returns
+// false if there are too many outstanding queries.
+func (ts *transactions) add(tx *transaction) (string, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if len(ts.m) >= maxTransactions {
+		return "", false
+	}
+
+	for {
+		tid := string(randBytes(4))
+		if _, ok := ts.m[tid]; ok {
+			continue
+		}
+
+		tx.tid = tid
+		tx.sent = time.Now()
+		ts.m[tid] = tx
+		return tid, true
+	}
+}
+
+// finish removes and returns the transaction a reply from the given address
+// answers, or nil if the reply was not solicited by us.
+func (ts *transactions) finish(tid string, from net.UDPAddr) *transaction {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	tx, ok := ts.m[tid]
+	if !ok {
+		ts.unsolicited.Add(1)
+		return nil
+	}
+
+	if tx.to.String() != from.String() {
+		ts.forged.Add(1)
+		return nil
+	}
+
+	delete(ts.m, tid)
+	return tx
+}
+
+// expire removes and returns the transactions which have timed out.
+func (ts *transactions) expire() []*transaction {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var expired []*transaction
+	for tid, tx := range ts.m {
+		if time.Since(tx.sent) > transactionTimeout {
+			expired = append(expired, tx)
+			delete(ts.m, tid)
+		}
+	}
+
+	ts.timeouts.Add(uint64(len(expired)))
+	return expired
+}
+
+func (ts *transactions) len() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return len(ts.m)
+}
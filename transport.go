@@ -0,0 +1,12 @@
+package main
+
+import "net"
+
+// transport is what a DHT identity exchanges packets through: a UDP socket,
+// or a socket of a simulated network.
+type transport interface {
+	ReadFrom(p []byte) (n int, addr net.Addr, err error)
+	WriteTo(p []byte, addr net.Addr) (n int, err error)
+	LocalAddr() net.Addr
+	Close() error
+}
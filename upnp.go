@@ -15,23 +15,26 @@ type PortMapping struct {
 }
 
 // SetupPortForwarding attempts to set up UPnP port forwarding rules for the specified ports and protocols.
-func SetupPortForwarding(portMappings []PortMapping) error {
+// It returns the external IP address reported by the gateway, if any.
+func SetupPortForwarding(portMappings []PortMapping) (net.IP, error) {
 	// Discover UPnP devices
 	devices, err := goupnp.DiscoverDevices(internetgateway1.URN_WANIPConnection_1)
 	if err != nil {
-		return fmt.Errorf("error discovering devices: %v", err)
+		return nil, fmt.Errorf("error discovering devices: %v", err)
 	}
 
 	if len(devices) == 0 {
-		return fmt.Errorf("no UPnP devices found")
+		return nil, fmt.Errorf("no UPnP devices found")
 	}
 
 	// Retrieve the local IP address
 	localIP, err := getLocalIP()
 	if err != nil {
-		return fmt.Errorf("error getting local IP: %v", err)
+		return nil, fmt.Errorf("error getting local IP: %v", err)
 	}
 
+	var external net.IP
+
 	// Iterate over all discovered devices
 	for _, device := range devices {
 		// Create a WANIPConnection1 client for each device
@@ -50,6 +53,9 @@ func SetupPortForwarding(portMappings []PortMapping) error {
 			}
 
 			log.Printf("External IP address for device %s: %s", device.Location, externalIP)
+			if ip := net.ParseIP(externalIP); ip != nil && external == nil {
+				external = ip
+			}
 
 			// Add port mapping for each port and protocol
 			for _, mapping := range portMappings {
@@ -63,7 +69,7 @@ func SetupPortForwarding(portMappings []PortMapping) error {
 			}
 		}
 	}
-	return nil
+	return external, nil
 }
 
 // getLocalIP retrieves the local IP address of the machine.
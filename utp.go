@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// uTP packet types (BEP 29)
+const (
+	utpData  = 0
+	utpFin   = 1
+	utpState = 2
+	utpReset = 3
+	utpSyn   = 4
+)
+
+const (
+	utpVersion    = 1
+	utpHeaderSize = 20
+	// utpMaxPayload keeps packets below the usual path MTU.
+	utpMaxPayload = 1400 - utpHeaderSize
+	// utpRecvWindow is the receive window we advertise, utpSendWindow the
+	// most we have in flight whatever the peer advertises.
+	utpRecvWindow = 1 << 20
+	utpSendWindow = 64 << 10
+	// utpMaxOutOfOrder bounds the packets buffered ahead of a gap.
+	utpMaxOutOfOrder = 1024
+
+	utpInitialRTO     = time.Second
+	utpMaxRTO         = 8 * time.Second
+	utpMaxRetransmits = 5
+)
+
+var (
+	errUTPReset   = errors.New("utp connection reset by peer")
+	errUTPTimeout = errors.New("utp peer stopped acknowledging")
+)
+
+type utpHeader struct {
+	typ       byte
+	connID    uint16
+	timestamp uint32 // microseconds
+	timeDiff  uint32 // microseconds
+	wnd       uint32
+	seq       uint16
+	ack       uint16
+}
+
+func (h *utpHeader) encode(payload []byte) []byte {
+	b := make([]byte, utpHeaderSize, utpHeaderSize+len(payload))
+	b[0] = h.typ<<4 | utpVersion
+	binary.BigEndian.PutUint16(b[2:4], h.connID)
+	binary.BigEndian.PutUint32(b[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:12], h.timeDiff)
+	binary.BigEndian.PutUint32(b[12:16], h.wnd)
+	binary.BigEndian.PutUint16(b[16:18], h.seq)
+	binary.BigEndian.PutUint16(b[18:20], h.ack)
+	return append(b, payload...)
+}
+
+// decodeUTP returns the header and payload of a packet, skipping the
+// extensions, such as selective acks, which we do not use.
+func decodeUTP(b []byte) (h utpHeader, payload []byte, ok bool) {
+	if len(b) < utpHeaderSize || b[0]&0x0f != utpVersion || b[0]>>4 > utpSyn {
+		return h, nil, false
+	}
+
+	h = utpHeader{
+		typ:       b[0] >> 4,
+		connID:    binary.BigEndian.Uint16(b[2:4]),
+		timestamp: binary.BigEndian.Uint32(b[4:8]),
+		timeDiff:  binary.BigEndian.Uint32(b[8:12]),
+		wnd:       binary.BigEndian.Uint32(b[12:16]),
+		seq:       binary.BigEndian.Uint16(b[16:18]),
+		ack:       binary.BigEndian.Uint16(b[18:20]),
+	}
+
+	ext, payload := b[1], b[utpHeaderSize:]
+	for ext != 0 {
+		if len(payload) < 2 || len(payload) < 2+int(payload[1]) {
+			return h, nil, false
+		}
+		ext, payload = payload[0], payload[2+int(payload[1]):]
+	}
+	return h, payload, true
+}
+
+// seqLess compares uTP sequence numbers, which wrap around.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+func utpNow() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
+
+type utpPacket struct {
+	seq           uint16
+	data          []byte // the encoded packet
+	payload       int
+	sentAt        time.Time
+	transmissions int
+}
+
+type utpSegment struct {
+	data []byte
+	fin  bool
+}
+
+// utpConn is an outgoing uTP connection over a UDP socket of its own, enough
+// of BEP 29 to fetch metadata: a fixed window instead of LEDBAT congestion
+// control and no selective acks.
+type utpConn struct {
+	sock   net.PacketConn
+	remote *net.UDPAddr
+
+	mu        sync.Mutex
+	recvID    uint16
+	sendID    uint16
+	seq       uint16 // of the next packet we send
+	ack       uint16 // of the last packet received in order
+	timeDiff  uint32
+	peerWnd   uint32
+	unacked   []*utpPacket // in order of seq
+	rto       time.Duration
+	inbuf     []byte
+	ooo       map[uint16]utpSegment // received ahead of a gap
+	connected bool
+	eof       bool
+	err       error
+	closed    bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	established chan struct{}
+	readable    chan struct{}
+	writable    chan struct{}
+	die         chan struct{}
+	closeOnce   sync.Once
+}
+
+// dialUTP connects to addr over uTP.
+func dialUTP(ctx context.Context, addr string) (net.Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	sock, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+
+	id := binary.BigEndian.Uint16(randBytes(2))
+	c := &utpConn{
+		sock:        sock,
+		remote:      remote,
+		recvID:      id,
+		sendID:      id + 1,
+		seq:         1,
+		peerWnd:     utpSendWindow,
+		rto:         utpInitialRTO,
+		ooo:         make(map[uint16]utpSegment),
+		established: make(chan struct{}),
+		readable:    make(chan struct{}, 1),
+		writable:    make(chan struct{}, 1),
+		die:         make(chan struct{}),
+	}
+	go c.readLoop()
+	go c.timerLoop()
+
+	c.mu.Lock()
+	c.sendLocked(utpSyn, nil)
+	c.mu.Unlock()
+
+	select {
+	case <-c.established:
+		return c, nil
+	case <-c.readable:
+		// woken by an error before the connection was established
+		c.mu.Lock()
+		err = c.err
+		c.mu.Unlock()
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	c.Close()
+	return nil, err
+}
+
+// sendLocked sends a packet, keeping those which take a sequence number
+// until they are acked.
+func (c *utpConn) sendLocked(typ byte, payload []byte) {
+	h := utpHeader{
+		typ:       typ,
+		connID:    c.sendID,
+		timestamp: utpNow(),
+		timeDiff:  c.timeDiff,
+		wnd:       uint32(utpRecvWindow - min(len(c.inbuf), utpRecvWindow)),
+		seq:       c.seq,
+		ack:       c.ack,
+	}
+	if typ == utpSyn {
+		// the only packet sent with the ID we receive on
+		h.connID = c.recvID
+	}
+	data := h.encode(payload)
+
+	if typ != utpState {
+		c.unacked = append(c.unacked, &utpPacket{
+			seq:           c.seq,
+			data:          data,
+			payload:       len(payload),
+			sentAt:        time.Now(),
+			transmissions: 1,
+		})
+		c.seq++
+	}
+
+	c.sock.WriteTo(data, c.remote)
+}
+
+func (c *utpConn) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := c.sock.ReadFrom(buf)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		addr, ok := from.(*net.UDPAddr)
+		if !ok || !addr.IP.Equal(c.remote.IP) || addr.Port != c.remote.Port {
+			continue
+		}
+
+		h, payload, ok := decodeUTP(buf[:n])
+		if !ok || h.connID != c.recvID {
+			continue
+		}
+		c.onPacket(h, payload)
+	}
+}
+
+func (c *utpConn) onPacket(h utpHeader, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.timeDiff = utpNow() - h.timestamp
+	c.peerWnd = h.wnd
+
+	if h.typ == utpReset {
+		c.failLocked(errUTPReset)
+		return
+	}
+
+	if !c.connected {
+		if h.typ != utpState {
+			return
+		}
+		// the first data packet of the peer has the sequence number of
+		// its SYN-ACK
+		c.ack = h.seq - 1
+		c.connected = true
+		close(c.established)
+	}
+
+	// acks are cumulative
+	acked := 0
+	for acked < len(c.unacked) && !seqLess(h.ack, c.unacked[acked].seq) {
+		acked++
+	}
+	if acked > 0 {
+		c.unacked = c.unacked[acked:]
+		c.rto = utpInitialRTO
+		notify(c.writable)
+	}
+
+	switch h.typ {
+	case utpData, utpFin:
+		c.receiveLocked(h.seq, utpSegment{data: append([]byte(nil), payload...), fin: h.typ == utpFin})
+		// ack everything, duplicates too, in case our ack got lost
+		c.sendLocked(utpState, nil)
+		notify(c.readable)
+	}
+}
+
+// receiveLocked delivers a segment in order, or keeps it until the gap
+// before it is filled.
+func (c *utpConn) receiveLocked(seq uint16, seg utpSegment) {
+	if seq != c.ack+1 {
+		if ahead := seq - c.ack - 1; ahead < utpMaxOutOfOrder && !c.eof {
+			c.ooo[seq] = seg
+		}
+		return
+	}
+
+	for {
+		c.ack = seq
+		if !c.eof {
+			c.inbuf = append(c.inbuf, seg.data...)
+			c.eof = seg.fin
+		}
+
+		next, ok := c.ooo[c.ack+1]
+		if !ok {
+			return
+		}
+		delete(c.ooo, c.ack+1)
+		seq, seg = c.ack+1, next
+	}
+}
+
+// timerLoop retransmits the packets which were not acked in time.
+func (c *utpConn) timerLoop() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.die:
+			return
+		}
+
+		c.mu.Lock()
+		if len(c.unacked) > 0 && time.Since(c.unacked[0].sentAt) > c.rto {
+			if c.unacked[0].transmissions > utpMaxRetransmits {
+				c.failLocked(errUTPTimeout)
+				c.mu.Unlock()
+				return
+			}
+
+			for _, p := range c.unacked {
+				// the ack number may have moved on since
+				binary.BigEndian.PutUint16(p.data[18:20], c.ack)
+				c.sock.WriteTo(p.data, c.remote)
+				p.sentAt = time.Now()
+				p.transmissions++
+			}
+			c.rto = min(c.rto*2, utpMaxRTO)
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *utpConn) fail(err error) {
+	c.mu.Lock()
+	c.failLocked(err)
+	c.mu.Unlock()
+}
+
+func (c *utpConn) failLocked(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	notify(c.readable)
+	notify(c.writable)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ch is notified, the deadline passes or c is closed.
+func (c *utpConn) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-c.die:
+		return net.ErrClosed
+	}
+}
+
+func (c *utpConn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.inbuf) > 0 {
+			n := copy(p, c.inbuf)
+			c.inbuf = c.inbuf[n:]
+			c.mu.Unlock()
+			return n, nil
+		}
+		eof, err, deadline := c.eof, c.err, c.readDeadline
+		c.mu.Unlock()
+
+		switch {
+		case eof:
+			return 0, io.EOF
+		case err != nil:
+			return 0, err
+		}
+
+		if err := c.wait(c.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *utpConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return written, net.ErrClosed
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return written, err
+		}
+
+		inflight := 0
+		for _, packet := range c.unacked {
+			inflight += packet.payload
+		}
+		window := min(int(c.peerWnd), utpSendWindow)
+		chunk := min(len(p)-written, utpMaxPayload)
+
+		if inflight > 0 && inflight+chunk > window {
+			deadline := c.writeDeadline
+			c.mu.Unlock()
+			if err := c.wait(c.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		c.sendLocked(utpData, p[written:written+chunk])
+		written += chunk
+		c.mu.Unlock()
+	}
+	return written, nil
+}
+
+func (c *utpConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		if c.connected && c.err == nil {
+			// best effort, we do not wait for the FIN to be acked
+			c.sendLocked(utpFin, nil)
+		}
+		c.closed = true
+		c.mu.Unlock()
+
+		close(c.die)
+		c.sock.Close()
+	})
+	return nil
+}
+
+func (c *utpConn) LocalAddr() net.Addr {
+	return c.sock.LocalAddr()
+}
+
+func (c *utpConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *utpConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *utpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *utpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}